@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/devisions/go-playground/go-directio/config"
+	"github.com/devisions/go-playground/go-directio/queue"
+)
+
+// Size of the appended payloads.
+const payloadSize = 200
+
+// Block size used by all the scenarios.
+const blocksize = 4096
+
+// scenario tells how the records get appended: one by one (`batch` is 1, using `Writer.Append`)
+// or in groups (using `Writer.AppendBatch`), with the blocks written from a buffer of `buffer` bytes.
+type scenario struct {
+	records  int
+	batch    int
+	buffer   int
+	syncMode string
+}
+
+func (s scenario) String() string {
+	how := "one by one"
+	if s.batch > 1 {
+		how = fmt.Sprintf("groups of %d", s.batch)
+	}
+	return fmt.Sprintf("%-13s %5d KiB buffer  sync: %-6s", how, s.buffer/1024, s.syncMode)
+}
+
+// Comparing the throughput and the latency of appending records one by one, with each full block being written
+// on its own (the baseline), against appending them in groups (aka group commit), with the full blocks written
+// together and the sync policy applied once per group. The latency of a record is the one of the call that appended it,
+// so a record of a group waits for all of them. The files are written in the path provided as the optional argument
+// (default: a temporary directory), so that the scenarios can be compared on the same disk.
+func main() {
+	log.SetOutput(io.Discard) // The queue logs its progress (ex: the files it moves to).
+	dir := ""
+	if len(os.Args) > 1 {
+		dir = os.Args[1]
+	}
+	dir, err := os.MkdirTemp(dir, "batch_eval")
+	if err != nil {
+		fail("Failed to create the directory. Reason:", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	fmt.Printf(">>> Appending records of %d bytes (payload) using %d bytes blocks, into %s\n", payloadSize, blocksize, dir)
+	for i, s := range []scenario{
+		{records: 51_200, batch: 1, buffer: blocksize, syncMode: queue.SYNC_NONE},
+		{records: 51_200, batch: 64, buffer: 256 * 1024, syncMode: queue.SYNC_NONE},
+		{records: 51_200, batch: 256, buffer: 1024 * 1024, syncMode: queue.SYNC_NONE},
+		{records: 2_048, batch: 1, buffer: blocksize, syncMode: queue.SYNC_ALWAYS},
+		{records: 2_048, batch: 64, buffer: 256 * 1024, syncMode: queue.SYNC_ALWAYS},
+		{records: 2_048, batch: 256, buffer: 1024 * 1024, syncMode: queue.SYNC_ALWAYS},
+	} {
+		if err := run(filepath.Join(dir, fmt.Sprint(i)), s); err != nil {
+			fail("Failed to run scenario", s, "Reason:", err)
+		}
+	}
+}
+
+// run appends the records of the scenario into a new path, printing the throughput and the latency.
+func run(path string, s scenario) error {
+	cfg := &config.Config{
+		BlockSize:        blocksize,
+		MaxFileSizeBytes: 64 * 1024 * 1024,
+		Path:             path,
+		SyncMode:         s.syncMode,
+		DirectIOPolicy:   queue.DIRECT_IO_FALLBACK,
+		WriteBufferBytes: s.buffer,
+	}
+	w, err := queue.NewWriter(cfg)
+	if err != nil {
+		return err
+	}
+	payloads := make([][]byte, s.batch)
+	for i := range payloads {
+		payloads[i] = make([]byte, payloadSize)
+		rand.Read(payloads[i])
+	}
+
+	latencies := make([]time.Duration, 0, s.records)
+	start := time.Now()
+	for n := 0; n < s.records; n += s.batch {
+		callStart := time.Now()
+		if s.batch == 1 {
+			err = w.Append(payloads[0])
+		} else {
+			err = w.AppendBatch(payloads)
+		}
+		if err != nil {
+			_ = w.Close()
+			return err
+		}
+		d := time.Since(callStart)
+		for i := 0; i < s.batch; i++ {
+			latencies = append(latencies, d)
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	elapsed := time.Since(start)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	var total time.Duration
+	for _, l := range latencies {
+		total += l
+	}
+	records := len(latencies)
+	fmt.Printf(">>> %s  %6d records  %8.0f records/s  %6.1f MB/s  latency  mean: %9s  p99: %9s  (%s I/O)\n",
+		s, records, float64(records)/elapsed.Seconds(), float64(records*payloadSize)/elapsed.Seconds()/1e6,
+		total/time.Duration(records), latencies[records*99/100], w.IOMode())
+	return nil
+}
+
+// fail prints the reason and exits.
+func fail(a ...interface{}) {
+	fmt.Println(append([]interface{}{">>>"}, a...)...)
+	os.Exit(1)
+}
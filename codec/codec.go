@@ -0,0 +1,75 @@
+// Package codec provides the codecs used for encoding and decoding the values written into and read from a queue.
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Codec encodes and decodes values of type T.
+// Its ID is stored in each record's header, so that readers pick the right codec.
+type Codec[T any] interface {
+	ID() byte
+	Name() string
+	Encode(v T) ([]byte, error)
+	Decode(from []byte) (T, error)
+}
+
+// IDs of the generic codecs. Other codecs (specific to a type) must use different IDs.
+const (
+	// Used for the (raw) payloads that are written as they are.
+	RawID  = 0
+	GobID  = 1
+	JSONID = 2
+)
+
+// Gob uses `encoding/gob`. Since each record must be decoded on its own,
+// the type descriptor is part of every encoded value.
+type Gob[T any] struct{}
+
+func (Gob[T]) ID() byte     { return GobID }
+func (Gob[T]) Name() string { return "gob" }
+
+func (Gob[T]) Encode(v T) ([]byte, error) {
+	buf := bytes.Buffer{}
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, errors.Wrap(err, "encoding data")
+	}
+	return buf.Bytes(), nil
+}
+
+func (Gob[T]) Decode(from []byte) (T, error) {
+	var v T
+	dec := gob.NewDecoder(bytes.NewReader(from))
+	err := dec.Decode(&v)
+	if err != nil && err != io.EOF {
+		return v, errors.Wrap(err, "decoding data")
+	}
+	return v, nil
+}
+
+// JSON uses `encoding/json`.
+type JSON[T any] struct{}
+
+func (JSON[T]) ID() byte     { return JSONID }
+func (JSON[T]) Name() string { return "json" }
+
+func (JSON[T]) Encode(v T) ([]byte, error) {
+	ed, err := json.Marshal(v)
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding data")
+	}
+	return ed, nil
+}
+
+func (JSON[T]) Decode(from []byte) (T, error) {
+	var v T
+	if err := json.Unmarshal(from, &v); err != nil {
+		return v, errors.Wrap(err, "decoding data")
+	}
+	return v, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/devisions/go-playground/go-directio/internal/data"
+)
+
+const charset = "abcdefghijklmnopqrstuvwxyz" +
+	"ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// Comparing the available codecs: encoded size and time spent (ns/op) for encoding and decoding.
+// Gob is the one used before having codecs, that's the baseline.
+func main() {
+
+	codecs := data.Codecs()
+
+	for _, textLen := range []int{16, 64, 330, 600} {
+
+		d := data.SomeData{
+			Text:   randString(textLen),
+			Number: rand.Uint64(),
+		}
+		fmt.Printf(">>> SomeData having %d chars of Text\n", textLen)
+
+		for _, c := range codecs {
+			ed, err := c.Encode(d)
+			if err != nil {
+				fmt.Println(">>> encoding error:", err)
+				continue
+			}
+
+			encRes := testing.Benchmark(func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					_, _ = c.Encode(d)
+				}
+			})
+			decRes := testing.Benchmark(func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					_, _ = c.Decode(ed)
+				}
+			})
+
+			fmt.Printf(">>> %-6s  size: %4d bytes  encode: %6d ns/op  decode: %6d ns/op\n",
+				c.Name(), len(ed), encRes.NsPerOp(), decRes.NsPerOp())
+		}
+	}
+}
+
+func randString(length int) string {
+	b := make([]byte, length)
+	for i := range b {
+		b[i] = charset[rand.Intn(len(charset))]
+	}
+	return string(b)
+}
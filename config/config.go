@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/pkg/errors"
@@ -13,12 +14,139 @@ const (
 	IO_BLOCK_SIZE          = "IO_BLOCK_SIZE"
 	IO_MAX_FILE_SIZE_BYTES = "IO_MAX_FILE_SIZE_BYTES"
 	IO_PATH                = "IO_PATH"
+	IO_CODEC               = "IO_CODEC"
+	IO_CONSUMER_START_TIME = "IO_CONSUMER_START_TIME"
+	IO_CONSUMER_NAME       = "IO_CONSUMER_NAME"
+
+	IO_RETENTION_MAX_AGE         = "IO_RETENTION_MAX_AGE"
+	IO_RETENTION_MAX_BYTES       = "IO_RETENTION_MAX_BYTES"
+	IO_RETENTION_MAX_SEGMENTS    = "IO_RETENTION_MAX_SEGMENTS"
+	IO_RETENTION_DELETE_CONSUMED = "IO_RETENTION_DELETE_CONSUMED"
+	IO_RETENTION_CHECK_INTERVAL  = "IO_RETENTION_CHECK_INTERVAL"
+
+	IO_ARCHIVE_PATH            = "IO_ARCHIVE_PATH"
+	IO_ARCHIVE_COMPRESS        = "IO_ARCHIVE_COMPRESS"
+	IO_ARCHIVE_MAX_AGE         = "IO_ARCHIVE_MAX_AGE"
+	IO_ARCHIVE_MAX_BYTES       = "IO_ARCHIVE_MAX_BYTES"
+	IO_ARCHIVE_MAX_SEGMENTS    = "IO_ARCHIVE_MAX_SEGMENTS"
+	IO_CONSUMER_REPLAY_ARCHIVE = "IO_CONSUMER_REPLAY_ARCHIVE"
+
+	IO_SYNC_MODE          = "IO_SYNC_MODE"
+	IO_SYNC_EVERY_RECORDS = "IO_SYNC_EVERY_RECORDS"
+	IO_SYNC_EVERY_BYTES   = "IO_SYNC_EVERY_BYTES"
+	IO_SYNC_INTERVAL      = "IO_SYNC_INTERVAL"
+
+	IO_CONSUMER_COMMIT_MODE          = "IO_CONSUMER_COMMIT_MODE"
+	IO_CONSUMER_COMMIT_EVERY_RECORDS = "IO_CONSUMER_COMMIT_EVERY_RECORDS"
+	IO_CONSUMER_COMMIT_INTERVAL      = "IO_CONSUMER_COMMIT_INTERVAL"
+	IO_CONSUMER_READ_COMMITTED       = "IO_CONSUMER_READ_COMMITTED"
+
+	IO_PRODUCER_DEDUP_SEGMENTS = "IO_PRODUCER_DEDUP_SEGMENTS"
+
+	IO_PREALLOCATE      = "IO_PREALLOCATE"
+	IO_RECYCLE_SEGMENTS = "IO_RECYCLE_SEGMENTS"
+
+	IO_DIRECT_POLICY = "IO_DIRECT_POLICY"
+
+	IO_WRITE_BUFFER_BYTES     = "IO_WRITE_BUFFER_BYTES"
+	IO_READ_BUFFER_BYTES      = "IO_READ_BUFFER_BYTES"
+	IO_PRODUCER_BATCH_RECORDS = "IO_PRODUCER_BATCH_RECORDS"
+	IO_PRODUCER_LINGER        = "IO_PRODUCER_LINGER"
+
+	IO_ENGINE             = "IO_ENGINE"
+	IO_ENGINE_QUEUE_DEPTH = "IO_ENGINE_QUEUE_DEPTH"
 )
 
+// The codec used when `IO_CODEC` is not defined.
+const DEFAULT_CODEC = "gob"
+
+// The consumer name used when `IO_CONSUMER_NAME` is not defined.
+const DEFAULT_CONSUMER_NAME = "consumer"
+
+// How often the retention is applied when `IO_RETENTION_CHECK_INTERVAL` is not defined.
+const DEFAULT_RETENTION_CHECK_INTERVAL = 10 * time.Second
+
+// The sync mode used when `IO_SYNC_MODE` is not defined: never sync.
+const DEFAULT_SYNC_MODE = "none"
+
+// The commit mode used when `IO_CONSUMER_COMMIT_MODE` is not defined: save the state on each commit.
+const DEFAULT_CONSUMER_COMMIT_MODE = "always"
+
+// How many of the latest files are scanned for the sequence numbers of the idempotent producers,
+// when `IO_PRODUCER_DEDUP_SEGMENTS` is not defined.
+const DEFAULT_PRODUCER_DEDUP_SEGMENTS = 4
+
+// The direct I/O policy used when `IO_DIRECT_POLICY` is not defined: refuse a path that does not support O_DIRECT.
+const DEFAULT_DIRECT_POLICY = "require"
+
+// The number of records that the producer appends as a group when `IO_PRODUCER_BATCH_RECORDS` is not defined: no grouping.
+const DEFAULT_PRODUCER_BATCH_RECORDS = 1
+
+// The I/O engine used when `IO_ENGINE` is not defined: blocking reads and writes.
+const DEFAULT_ENGINE = "sync"
+
+// How many reads or writes the io_uring engine keeps in flight when `IO_ENGINE_QUEUE_DEPTH` is not defined.
+const DEFAULT_ENGINE_QUEUE_DEPTH = 32
+
 type Config struct {
+	// The size of the blocks written and read. If 0, it gets derived from the direct I/O alignment of `Path` (see `queue.ResolveBlockSize`).
 	BlockSize        int
 	MaxFileSizeBytes int64
 	Path             string
+	Codec            string
+	// If not zero, the consumer starts with the first record produced at or after it, instead of using its state.
+	ConsumerStartTime time.Time
+	// The name of the consumer, that its state file is named after.
+	ConsumerName string
+	// The retention of the files. A zero limit means there is no such limit.
+	RetentionMaxAge         time.Duration
+	RetentionMaxBytes       int64
+	RetentionMaxSegments    int
+	RetentionDeleteConsumed bool
+	RetentionCheckInterval  time.Duration
+	// If not empty, the files removed by the retention get moved (and, optionally, compressed) into this path.
+	ArchivePath     string
+	ArchiveCompress bool
+	// The retention of the archived files. A zero limit means there is no such limit.
+	ArchiveMaxAge      time.Duration
+	ArchiveMaxBytes    int64
+	ArchiveMaxSegments int
+	// Whether the consumer reads the archived files as well, before the ones of the path.
+	ConsumerReplayArchive bool
+	// When the producer syncs the written data to the storage device:
+	// none, always, records (every N), bytes (every N), interval or dsync (O_DSYNC).
+	SyncMode         string
+	SyncEveryRecords int
+	SyncEveryBytes   int64
+	SyncInterval     time.Duration
+	// When the consumer saves its commits to its state file:
+	// always, records (every N, in the background), interval (in the background) or explicit.
+	ConsumerCommitMode         string
+	ConsumerCommitEveryRecords int
+	ConsumerCommitInterval     time.Duration
+	// Whether the consumer reads only the records of committed transactions (besides the ones not part of any transaction).
+	ConsumerReadCommitted bool
+	// How many of the latest files the Writer scans on startup, for the sequence numbers of the idempotent producers (0 means all).
+	ProducerDedupSegments int
+	// Whether the producer preallocates each file to `MaxFileSizeBytes` (using fallocate).
+	Preallocate bool
+	// How many of the files deleted by the retention (when consumed by all the consumers) are kept for being reused
+	// as new files (0 means none). Recycling the files implies preallocating them.
+	RecycleSegments int
+	// What to do if the file system of `Path` does not support direct I/O (O_DIRECT): fail or fall back to buffered I/O.
+	DirectIOPolicy string
+	// Size of the buffer that the Writer fills with blocks, writing them together once it is full (0 means a single block).
+	WriteBufferBytes int
+	// Size of the buffer that the Reader reads several blocks into at once, ahead of the records (0 means a single block).
+	ReadBufferBytes int
+	// The maximum number of queued records that the producer appends as a group.
+	ProducerBatchRecords int
+	// How long the producer waits for more records to be queued, before appending a group that is not full.
+	ProducerLinger time.Duration
+	// The engine doing the reads and writes of the blocks: sync, pwritev or io_uring.
+	Engine string
+	// The maximum number of reads or writes that the io_uring engine keeps in flight.
+	EngineQueueDepth int
 }
 
 // Load is loading the configuration items from .env file.
@@ -29,21 +157,16 @@ func Load() (*Config, error) {
 		return nil, errors.Wrap(err, "loading .env file")
 	}
 
-	val, defined := os.LookupEnv(IO_BLOCK_SIZE)
-	if !defined {
-		return nil, errors.New(fmt.Sprint("Could not read", IO_BLOCK_SIZE, "from config file"))
+	// If not defined (or empty), the block size gets detected.
+	if err := optionalInt(IO_BLOCK_SIZE, &c.BlockSize); err != nil {
+		return nil, err
 	}
-	n, err := strconv.Atoi(val)
-	if err != nil {
-		return nil, errors.New(fmt.Sprint("Unable to use the", IO_BLOCK_SIZE, "config item value. Reason:", err))
-	}
-	c.BlockSize = n
 
-	val, defined = os.LookupEnv(IO_MAX_FILE_SIZE_BYTES)
+	val, defined := os.LookupEnv(IO_MAX_FILE_SIZE_BYTES)
 	if !defined {
 		return nil, errors.New(fmt.Sprint("Could not read", IO_MAX_FILE_SIZE_BYTES, "from config file"))
 	}
-	n, err = strconv.Atoi(val)
+	n, err := strconv.Atoi(val)
 	if err != nil {
 		return nil, errors.New(fmt.Sprint("Unable to use the", IO_MAX_FILE_SIZE_BYTES, "config item value. Reason:", err))
 	}
@@ -55,5 +178,137 @@ func Load() (*Config, error) {
 	}
 	c.Path = val
 
+	// Optional items.
+
+	c.Codec = DEFAULT_CODEC
+	if val, defined = os.LookupEnv(IO_CODEC); defined {
+		c.Codec = val
+	}
+
+	if val, defined = os.LookupEnv(IO_CONSUMER_START_TIME); defined && val != "" {
+		t, err := time.Parse(time.RFC3339, val)
+		if err != nil {
+			return nil, errors.New(fmt.Sprint("Unable to use the", IO_CONSUMER_START_TIME, "config item value. Reason:", err))
+		}
+		c.ConsumerStartTime = t
+	}
+
+	c.ConsumerName = DEFAULT_CONSUMER_NAME
+	if val, defined = os.LookupEnv(IO_CONSUMER_NAME); defined && val != "" {
+		c.ConsumerName = val
+	}
+
+	c.RetentionCheckInterval = DEFAULT_RETENTION_CHECK_INTERVAL
+	c.ProducerDedupSegments = DEFAULT_PRODUCER_DEDUP_SEGMENTS
+	c.ProducerBatchRecords = DEFAULT_PRODUCER_BATCH_RECORDS
+	c.EngineQueueDepth = DEFAULT_ENGINE_QUEUE_DEPTH
+	for _, err := range []error{
+		optionalDuration(IO_RETENTION_MAX_AGE, &c.RetentionMaxAge),
+		optionalInt64(IO_RETENTION_MAX_BYTES, &c.RetentionMaxBytes),
+		optionalInt(IO_RETENTION_MAX_SEGMENTS, &c.RetentionMaxSegments),
+		optionalBool(IO_RETENTION_DELETE_CONSUMED, &c.RetentionDeleteConsumed),
+		optionalDuration(IO_RETENTION_CHECK_INTERVAL, &c.RetentionCheckInterval),
+		optionalBool(IO_ARCHIVE_COMPRESS, &c.ArchiveCompress),
+		optionalDuration(IO_ARCHIVE_MAX_AGE, &c.ArchiveMaxAge),
+		optionalInt64(IO_ARCHIVE_MAX_BYTES, &c.ArchiveMaxBytes),
+		optionalInt(IO_ARCHIVE_MAX_SEGMENTS, &c.ArchiveMaxSegments),
+		optionalBool(IO_CONSUMER_REPLAY_ARCHIVE, &c.ConsumerReplayArchive),
+		optionalInt(IO_SYNC_EVERY_RECORDS, &c.SyncEveryRecords),
+		optionalInt64(IO_SYNC_EVERY_BYTES, &c.SyncEveryBytes),
+		optionalDuration(IO_SYNC_INTERVAL, &c.SyncInterval),
+		optionalInt(IO_CONSUMER_COMMIT_EVERY_RECORDS, &c.ConsumerCommitEveryRecords),
+		optionalDuration(IO_CONSUMER_COMMIT_INTERVAL, &c.ConsumerCommitInterval),
+		optionalBool(IO_CONSUMER_READ_COMMITTED, &c.ConsumerReadCommitted),
+		optionalInt(IO_PRODUCER_DEDUP_SEGMENTS, &c.ProducerDedupSegments),
+		optionalBool(IO_PREALLOCATE, &c.Preallocate),
+		optionalInt(IO_RECYCLE_SEGMENTS, &c.RecycleSegments),
+		optionalInt(IO_WRITE_BUFFER_BYTES, &c.WriteBufferBytes),
+		optionalInt(IO_READ_BUFFER_BYTES, &c.ReadBufferBytes),
+		optionalInt(IO_PRODUCER_BATCH_RECORDS, &c.ProducerBatchRecords),
+		optionalDuration(IO_PRODUCER_LINGER, &c.ProducerLinger),
+		optionalInt(IO_ENGINE_QUEUE_DEPTH, &c.EngineQueueDepth),
+	} {
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.ArchivePath = os.Getenv(IO_ARCHIVE_PATH)
+
+	c.SyncMode = DEFAULT_SYNC_MODE
+	if val, defined = os.LookupEnv(IO_SYNC_MODE); defined && val != "" {
+		c.SyncMode = val
+	}
+
+	c.ConsumerCommitMode = DEFAULT_CONSUMER_COMMIT_MODE
+	if val, defined = os.LookupEnv(IO_CONSUMER_COMMIT_MODE); defined && val != "" {
+		c.ConsumerCommitMode = val
+	}
+
+	c.DirectIOPolicy = DEFAULT_DIRECT_POLICY
+	if val, defined = os.LookupEnv(IO_DIRECT_POLICY); defined && val != "" {
+		c.DirectIOPolicy = val
+	}
+
+	c.Engine = DEFAULT_ENGINE
+	if val, defined = os.LookupEnv(IO_ENGINE); defined && val != "" {
+		c.Engine = val
+	}
+
 	return &c, nil
 }
+
+// optionalDuration parses the value of the optional item `name` into `to`, if it is defined and not empty.
+func optionalDuration(name string, to *time.Duration) error {
+	val, defined := os.LookupEnv(name)
+	if !defined || val == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return errors.New(fmt.Sprint("Unable to use the", name, "config item value. Reason:", err))
+	}
+	*to = d
+	return nil
+}
+
+// optionalInt64 parses the value of the optional item `name` into `to`, if it is defined and not empty.
+func optionalInt64(name string, to *int64) error {
+	val, defined := os.LookupEnv(name)
+	if !defined || val == "" {
+		return nil
+	}
+	n, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return errors.New(fmt.Sprint("Unable to use the", name, "config item value. Reason:", err))
+	}
+	*to = n
+	return nil
+}
+
+// optionalInt parses the value of the optional item `name` into `to`, if it is defined and not empty.
+func optionalInt(name string, to *int) error {
+	val, defined := os.LookupEnv(name)
+	if !defined || val == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		return errors.New(fmt.Sprint("Unable to use the", name, "config item value. Reason:", err))
+	}
+	*to = n
+	return nil
+}
+
+// optionalBool parses the value of the optional item `name` into `to`, if it is defined and not empty.
+func optionalBool(name string, to *bool) error {
+	val, defined := os.LookupEnv(name)
+	if !defined || val == "" {
+		return nil
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return errors.New(fmt.Sprint("Unable to use the", name, "config item value. Reason:", err))
+	}
+	*to = b
+	return nil
+}
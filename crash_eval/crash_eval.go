@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/devisions/go-playground/go-directio/config"
+	"github.com/devisions/go-playground/go-directio/internal/data"
+	"github.com/devisions/go-playground/go-directio/queue"
+	"github.com/pkg/errors"
+)
+
+// Number of records produced, that the consumer must process.
+const records = 500
+
+// Maximum number of consumer runs, before giving up.
+const maxRuns = 2000
+
+// Chances (out of 1000, for each record) of the consumer (child process) dying or its handler failing.
+const (
+	dieBeforeHandlingChance = 5
+	dieBeforeCommitChance   = 10
+	dieAfterCommitChance    = 5
+	failHandlingChance      = 10
+)
+
+// Exit code of a consumer that found a value not being delivered again after its handler failed.
+const exitNotRedelivered = 3
+
+// Commits between the saves of the state, when they are batched (and in explicit mode).
+const commitEveryRecords = 10
+
+// Interval between the saves of the state, in COMMIT_INTERVAL mode.
+const commitInterval = 5 * time.Millisecond
+
+// Checking the at-least-once delivery of `queue.Queue.Consume`: records get produced, then a consumer
+// (a child process, started again and again) processes them, while dying (SIGKILL) at random moments:
+// before handling a record, after handling it (but before the commit) and after the commit.
+// Its handler also fails at random, in which case the same record must be delivered again.
+// Each processed record is appended (and synced) to a log, that is checked in the end:
+// no record is missing, they are processed in order and the duplicates are only due to the deaths.
+// The consumer's commit mode (see `queue.CommitPolicy`) is the optional argument (default: always).
+func main() {
+	log.SetOutput(io.Discard) // The queue logs its progress (ex: the files it moves to).
+	if len(os.Args) == 5 && os.Args[1] == "child" {
+		seed, _ := strconv.ParseInt(os.Args[3], 10, 64)
+		consume(os.Args[2], seed, os.Args[4])
+		return
+	}
+	commitMode := queue.COMMIT_ALWAYS
+	if len(os.Args) > 1 {
+		commitMode = os.Args[1]
+	}
+
+	dir, err := os.MkdirTemp("", "crash_eval")
+	if err != nil {
+		fail("creating the temp dir:", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	if err := produce(dir, commitMode); err != nil {
+		fail("producing:", err)
+	}
+	fmt.Printf(">>> Produced %d records into %s, consuming them using commit mode '%s'\n", records, dir, commitMode)
+
+	seed := time.Now().UnixNano()
+	deaths := 0
+	done := false
+	for run := 0; run < maxRuns && !done; run++ {
+		cmd := exec.Command(os.Args[0], "child", dir, strconv.FormatInt(seed+int64(run), 10), commitMode)
+		err := cmd.Run()
+		if err == nil {
+			done = true
+			break
+		}
+		if ee, ok := err.(*exec.ExitError); ok {
+			if ws, ok := ee.Sys().(syscall.WaitStatus); ok && ws.Signaled() && ws.Signal() == syscall.SIGKILL {
+				deaths++
+				continue
+			}
+			if ee.ExitCode() == exitNotRedelivered {
+				fail("FAILED: a record whose handling failed was not delivered again")
+			}
+		}
+		fail("FAILED: the consumer ended with:", err)
+	}
+	if !done {
+		fail(fmt.Sprintf("FAILED: the consumer did not finish in %d runs", maxRuns))
+	}
+	fmt.Printf(">>> The consumer finished, after dying %d times\n", deaths)
+
+	processed, err := readProcessed(dir)
+	if err != nil {
+		fail("reading the processed log:", err)
+	}
+	if err := verify(processed, deaths); err != nil {
+		fail("FAILED:", err)
+	}
+	fmt.Printf(">>> OK: all %d records got processed, in order, with %d duplicates\n", records, len(processed)-records)
+}
+
+// fail prints the reason and exits.
+func fail(a ...interface{}) {
+	fmt.Println(append([]interface{}{">>>"}, a...)...)
+	os.Exit(1)
+}
+
+func newConfig(dir string, commitMode string) *config.Config {
+	return &config.Config{
+		BlockSize:                  512,
+		MaxFileSizeBytes:           4096,
+		Path:                       filepath.Join(dir, "queue"),
+		ConsumerName:               "crash_eval",
+		SyncMode:                   queue.SYNC_NONE,
+		DirectIOPolicy:             queue.DIRECT_IO_FALLBACK, // The temporary directory might be on a tmpfs.
+		ConsumerCommitMode:         commitMode,
+		ConsumerCommitEveryRecords: commitEveryRecords,
+		ConsumerCommitInterval:     commitInterval,
+	}
+}
+
+// produce writes the records, each one having its index as the number.
+func produce(dir string, commitMode string) error {
+	w, err := queue.NewWriter(newConfig(dir, commitMode))
+	if err != nil {
+		return err
+	}
+	q, err := queue.NewQueue[data.SomeData](w, nil, data.Codecs()...)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < records; i++ {
+		if err := q.Write(data.SomeData{Text: fmt.Sprintf("record %d", i), Number: uint64(i)}); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// consume is the child process: it consumes the records until there is nothing else to read, dying at random.
+func consume(dir string, seed int64, commitMode string) {
+	rnd := rand.New(rand.NewSource(seed))
+	r, err := queue.NewReader(newConfig(dir, commitMode))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "init the reader:", err)
+		os.Exit(1)
+	}
+	q, err := queue.NewQueue[data.SomeData](nil, r, data.Codecs()...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "init the queue:", err)
+		os.Exit(1)
+	}
+	out, err := os.OpenFile(filepath.Join(dir, "processed.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "opening the processed log:", err)
+		os.Exit(1)
+	}
+
+	// The number of the record whose handling failed, that must be the next one delivered.
+	failed := int64(-1)
+	handle := func(item *queue.Item[data.SomeData]) error {
+		n := int64(item.Value.Number)
+		if failed >= 0 && n != failed {
+			os.Exit(exitNotRedelivered)
+		}
+		failed = -1
+		dieAt(rnd, dieBeforeHandlingChance)
+		if rnd.Intn(1000) < failHandlingChance {
+			failed = n
+			return errors.New("failing on purpose")
+		}
+		if _, err := fmt.Fprintln(out, n); err != nil {
+			return err
+		}
+		if err := out.Sync(); err != nil {
+			return err
+		}
+		dieAt(rnd, dieBeforeCommitChance)
+		return nil
+	}
+
+	for consumed := 1; ; consumed++ {
+		err := q.Consume(handle)
+		if err == os.ErrNotExist || err == io.EOF {
+			// Everything got consumed.
+			if err := r.Close(); err != nil {
+				fmt.Fprintln(os.Stderr, "closing the reader:", err)
+				os.Exit(1)
+			}
+			return
+		}
+		if _, ok := err.(*queue.HandlerError); ok {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "consuming:", err)
+			os.Exit(1)
+		}
+		if commitMode == queue.COMMIT_EXPLICIT && consumed%commitEveryRecords == 0 {
+			if err := r.FlushCommits(); err != nil {
+				fmt.Fprintln(os.Stderr, "flushing the commits:", err)
+				os.Exit(1)
+			}
+		}
+		dieAt(rnd, dieAfterCommitChance)
+	}
+}
+
+// dieAt kills the process, having the `chance` (out of 1000) to do so.
+func dieAt(rnd *rand.Rand, chance int) {
+	if rnd.Intn(1000) < chance {
+		// Killing itself (SIGKILL, or TerminateProcess on Windows), without running any deferred call.
+		if p, err := os.FindProcess(os.Getpid()); err == nil {
+			_ = p.Kill()
+		}
+		time.Sleep(time.Minute) // Waiting for the signal.
+	}
+}
+
+// readProcessed returns the numbers of the processed records, in the order they got processed.
+func readProcessed(dir string) ([]int, error) {
+	f, err := os.Open(filepath.Join(dir, "processed.log"))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	var processed []int
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		n, err := strconv.Atoi(sc.Text())
+		if err != nil {
+			return nil, err
+		}
+		processed = append(processed, n)
+	}
+	return processed, sc.Err()
+}
+
+// verify checks that all the records got processed, in order, and that the duplicates are only due to
+// the deaths: after a death, the records since the last saved commit get processed again, in order.
+func verify(processed []int, deaths int) error {
+	next := 0 // The first record never processed.
+	restarts := 0
+	prev := -1
+	for _, n := range processed {
+		switch {
+		case n == prev+1 && n <= next:
+			// In order.
+		case n < prev+1:
+			restarts++ // Going back to the last saved commit.
+		default:
+			return errors.New(fmt.Sprintf("record %d got processed after record %d", n, prev))
+		}
+		if n == next {
+			next++
+		}
+		prev = n
+	}
+	if next != records {
+		return errors.New(fmt.Sprintf("only %d of the %d records got processed", next, records))
+	}
+	if restarts > deaths {
+		return errors.New(fmt.Sprintf("the processing went back %d times, while the consumer died only %d times", restarts, deaths))
+	}
+	return nil
+}
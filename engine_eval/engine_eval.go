@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/devisions/go-playground/go-directio/config"
+	"github.com/devisions/go-playground/go-directio/internal/data"
+	"github.com/devisions/go-playground/go-directio/ioengine"
+	"github.com/devisions/go-playground/go-directio/queue"
+	"github.com/ncw/directio"
+	"github.com/pkg/errors"
+)
+
+// Block size used by all the scenarios.
+const blocksize = 4096
+
+// Size of the file written and read by each engine scenario.
+const fileSize = 64 * 1024 * 1024
+
+// The maximum number of reads or writes that io_uring keeps in flight.
+const queueDepth = 32
+
+// Size of the payloads appended by the queue scenarios.
+const payloadSize = 200
+
+// The engines, in the order they get compared.
+var engines = []string{ioengine.ENGINE_SYNC, ioengine.ENGINE_PWRITEV, ioengine.ENGINE_IO_URING}
+
+// The sizes of the Reader's buffer used by the queue scenarios: a single block and several blocks read at once.
+var readBuffers = []int{blocksize, 1024 * 1024}
+
+// request tells how the file gets written and read: `buffers` buffers of `size` bytes per call,
+// allocated separately or, if `adjacent`, being the blocks of a single buffer (as the queue passes them).
+type request struct {
+	buffers  int
+	size     int
+	adjacent bool
+}
+
+func (r request) String() string {
+	alloc := "separate"
+	if r.adjacent {
+		alloc = "adjacent"
+	}
+	return fmt.Sprintf("%4d x %4d KiB %s", r.buffers, r.size/1024, alloc)
+}
+
+// Comparing the I/O engines on the same disk: first by using them directly, writing and then reading a file
+// with calls of one or more (aligned) buffers, and then by appending and reading records through the queue.
+// The files are written in the path provided as the optional argument (default: a temporary directory).
+func main() {
+	log.SetOutput(io.Discard) // The queue logs its progress (ex: the files it moves to).
+	dir := ""
+	if len(os.Args) > 1 {
+		dir = os.Args[1]
+	}
+	dir, err := os.MkdirTemp(dir, "engine_eval")
+	if err != nil {
+		fail("Failed to create the directory. Reason:", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	fmt.Printf(">>> Writing and reading a file of %d MiB using %d bytes blocks, into %s\n", fileSize/1024/1024, blocksize, dir)
+	for _, r := range []request{{1, blocksize, false}, {64, blocksize, false}, {256, blocksize, true}, {1, 1024 * 1024, false}} {
+		for _, name := range engines {
+			if err := runEngine(filepath.Join(dir, "engine.dat"), name, r); err != nil {
+				fail("Failed to use the", name, "engine. Reason:", err)
+			}
+		}
+	}
+	fmt.Printf(">>> Appending (in groups of 256, using a 1 MiB buffer) and reading (using a %d KiB and a %d KiB buffer) records of %d bytes (payload)\n",
+		readBuffers[0]/1024, readBuffers[1]/1024, payloadSize)
+	for i, name := range engines {
+		if err := runQueue(filepath.Join(dir, fmt.Sprint(i)), name); err != nil {
+			fail("Failed to use the queue with the", name, "engine. Reason:", err)
+		}
+	}
+}
+
+// runEngine writes (appends to) the file, writes it again (as a preallocated or a recycled file gets written)
+// and then reads it using the engine, printing the throughput and the latency of the calls.
+func runEngine(fp, name string, r request) error {
+	e, err := ioengine.New(name, queueDepth)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = e.Close() }()
+	// The file is opened using buffered I/O, if its file system does not support direct I/O.
+	f, err := directio.OpenFile(fp, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0665)
+	mode := data.IO_MODE_DIRECT
+	if err != nil {
+		if f, err = os.OpenFile(fp, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0665); err != nil {
+			return err
+		}
+		mode = data.IO_MODE_BUFFERED
+	}
+	defer func() { _ = f.Close() }()
+	bufs := make([][]byte, r.buffers)
+	if r.adjacent {
+		buf := directio.AlignedBlock(r.buffers * r.size)
+		rand.Read(buf)
+		for i := range bufs {
+			bufs[i] = buf[i*r.size : (i+1)*r.size]
+		}
+	} else {
+		for i := range bufs {
+			bufs[i] = directio.AlignedBlock(r.size)
+			rand.Read(bufs[i])
+		}
+	}
+	callSize := int64(r.buffers * r.size)
+
+	// Extending the file might be serialized by the file system, while writing over its existing blocks might not.
+	for _, op := range []string{"append ", "rewrite"} {
+		var writes []time.Duration
+		start := time.Now()
+		for off := int64(0); off < fileSize; off += callSize {
+			callStart := time.Now()
+			if err := e.WriteAt(f, bufs, off); err != nil {
+				return err
+			}
+			writes = append(writes, time.Since(callStart))
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		printResult(op, name, r, time.Since(start), writes, mode)
+	}
+
+	var reads []time.Duration
+	start := time.Now()
+	for off := int64(0); off < fileSize; off += callSize {
+		callStart := time.Now()
+		n, err := e.ReadAt(f, bufs, off)
+		if err != nil {
+			return err
+		}
+		if int64(n) != callSize {
+			return errors.New(fmt.Sprintf("read %d bytes at position %d instead of %d", n, off, callSize))
+		}
+		reads = append(reads, time.Since(callStart))
+	}
+	printResult("read   ", name, r, time.Since(start), reads, mode)
+	return nil
+}
+
+// printResult prints the throughput of the calls and their latency.
+func printResult(op, name string, r request, elapsed time.Duration, latencies []time.Duration, mode string) {
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	var total time.Duration
+	for _, l := range latencies {
+		total += l
+	}
+	calls := len(latencies)
+	fmt.Printf(">>> %s  %-8s  %s per call  %7.1f MB/s  latency  mean: %9s  p99: %9s  (%s I/O)\n",
+		op, name, r, float64(fileSize)/elapsed.Seconds()/1e6, total/time.Duration(calls), latencies[calls*99/100], mode)
+}
+
+// runQueue appends the records into a new path and then reads them, with each of the read buffers, using the engine,
+// printing the throughput of each.
+func runQueue(path, name string) error {
+	const records, batch = 102_400, 256
+	cfg := &config.Config{
+		BlockSize:          blocksize,
+		MaxFileSizeBytes:   64 * 1024 * 1024,
+		Path:               path,
+		SyncMode:           queue.SYNC_NONE,
+		DirectIOPolicy:     queue.DIRECT_IO_FALLBACK,
+		WriteBufferBytes:   1024 * 1024,
+		Engine:             name,
+		EngineQueueDepth:   queueDepth,
+		ConsumerName:       config.DEFAULT_CONSUMER_NAME,
+		ConsumerCommitMode: queue.COMMIT_EXPLICIT,
+	}
+	w, err := queue.NewWriter(cfg)
+	if err != nil {
+		return err
+	}
+	payloads := make([][]byte, batch)
+	for i := range payloads {
+		payloads[i] = make([]byte, payloadSize)
+		rand.Read(payloads[i])
+	}
+	start := time.Now()
+	for n := 0; n < records; n += batch {
+		if err := w.AppendBatch(payloads); err != nil {
+			_ = w.Close()
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	appended := time.Since(start)
+
+	result := fmt.Sprintf("%-8s  %6d records  append: %8.0f records/s", name, records, float64(records)/appended.Seconds())
+	for _, rb := range readBuffers {
+		// Nothing gets committed, so each Reader starts from the first record.
+		cfg.ReadBufferBytes = rb
+		read, err := readQueue(cfg, records)
+		if err != nil {
+			return err
+		}
+		result += fmt.Sprintf("  read (%4d KiB): %8.0f records/s", rb/1024, float64(records)/read.Seconds())
+	}
+	fmt.Printf(">>> %s  (%s I/O)\n", result, w.IOMode())
+	return nil
+}
+
+// readQueue reads the records using a new Reader, returning how long it took.
+func readQueue(cfg *config.Config, records int) (time.Duration, error) {
+	r, err := queue.NewReader(cfg)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = r.Close() }()
+	start := time.Now()
+	for n := 0; n < records; n++ {
+		if _, err := r.Read(); err != nil {
+			return 0, errors.Wrap(err, fmt.Sprintf("reading record %d", n))
+		}
+	}
+	return time.Since(start), nil
+}
+
+// fail prints the reason and exits.
+func fail(a ...interface{}) {
+	fmt.Println(append([]interface{}{">>>"}, a...)...)
+	os.Exit(1)
+}
@@ -1,6 +1,6 @@
 module github.com/devisions/go-playground/go-directio
 
-go 1.15
+go 1.18
 
 require (
 	github.com/joho/godotenv v1.3.0
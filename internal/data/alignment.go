@@ -0,0 +1,79 @@
+package data
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/ncw/directio"
+	"github.com/pkg/errors"
+)
+
+// Ways of detecting the alignment required by direct I/O.
+const (
+	ALIGNMENT_STATX = "statx"
+	ALIGNMENT_PROBE = "probe"
+)
+
+// The greatest alignment tried when probing.
+const maxProbedAlignment = 64 * 1024
+
+// Alignment describes what direct I/O (O_DIRECT) requires on the files of a path.
+type Alignment struct {
+	// The alignment (in bytes) of the memory blocks read or written (0 if unknown).
+	Memory int
+	// The alignment (in bytes) of the positions and of the sizes of the reads and writes: the logical block size.
+	Offset int
+	// The size (in bytes) of the reads and writes that the file system prefers (0 if unknown).
+	Preferred int
+	// How it was detected: ALIGNMENT_STATX or ALIGNMENT_PROBE.
+	DetectedBy string
+}
+
+// DirectIOAlignment detects the alignment required by direct I/O on the files of the path, using a temporary file:
+// statx tells it (on Linux, since 6.1, for the file systems that report it) or, otherwise, it is the size of the smallest
+// block that can be written (at a position of the same size). It returns nil if the path does not support direct I/O.
+func DirectIOAlignment(dir string) (*Alignment, error) {
+	tmp, err := os.CreateTemp(dir, ".directio-probe-*")
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("creating a probe file in path '%s'", dir))
+	}
+	filepath := tmp.Name()
+	_ = tmp.Close()
+	defer func() { _ = os.Remove(filepath) }()
+
+	a, err := statxAlignment(filepath)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("getting the direct I/O alignment of the probe file %s", filepath))
+	}
+	if a != nil {
+		if a.Offset == 0 {
+			return nil, nil // Direct I/O is not supported.
+		}
+		return a, nil
+	}
+	return probeAlignment(filepath)
+}
+
+// probeAlignment writes blocks of increasing sizes (powers of 2) into the file, using direct I/O,
+// until one of them succeeds. It returns nil if the file cannot be opened using direct I/O.
+func probeAlignment(filepath string) (*Alignment, error) {
+	f, err := directio.OpenFile(filepath, os.O_RDWR, 0665)
+	if errors.Is(err, syscall.EINVAL) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("opening the probe file %s", filepath))
+	}
+	defer func() { _ = f.Close() }()
+	for size := 1; size <= maxProbedAlignment; size *= 2 {
+		_, err := f.WriteAt(directio.AlignedBlock(size), int64(size))
+		if err == nil {
+			return &Alignment{Offset: size, DetectedBy: ALIGNMENT_PROBE}, nil
+		}
+		if !errors.Is(err, syscall.EINVAL) {
+			return nil, errors.Wrap(err, fmt.Sprintf("writing a block of %d bytes to the probe file %s", size, filepath))
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("no block of up to %d bytes could be written to the probe file %s", maxProbedAlignment, filepath))
+}
@@ -0,0 +1,45 @@
+//go:build linux && (amd64 || arm64)
+
+package data
+
+import (
+	"encoding/binary"
+	"syscall"
+	"unsafe"
+)
+
+// The statx mask bit asking for the direct I/O alignment.
+const statxDioAlign = 0x2000
+
+// The directory file descriptor that makes statx resolve a relative path against the working directory.
+const atFdCwd = -100
+
+// statxAlignment gets the direct I/O alignment of the file using statx. It returns nil if statx
+// is not supported or does not report it (ex: the kernel is older than 6.1 or the file system does not).
+// A zero `Offset` means that the file does not support direct I/O.
+func statxAlignment(filepath string) (*Alignment, error) {
+	p, err := syscall.BytePtrFromString(filepath)
+	if err != nil {
+		return nil, err
+	}
+	// The statx struct: stx_mask at 0, stx_blksize at 4, stx_dio_mem_align at 152 and stx_dio_offset_align at 156.
+	var buf [256]byte
+	dirfd := atFdCwd
+	_, _, errno := syscall.Syscall6(sysStatx, uintptr(dirfd), uintptr(unsafe.Pointer(p)), 0, statxDioAlign,
+		uintptr(unsafe.Pointer(&buf[0])), 0)
+	if errno == syscall.ENOSYS {
+		return nil, nil
+	}
+	if errno != 0 {
+		return nil, errno
+	}
+	if binary.LittleEndian.Uint32(buf[0:4])&statxDioAlign == 0 {
+		return nil, nil
+	}
+	return &Alignment{
+		Memory:     int(binary.LittleEndian.Uint32(buf[152:156])),
+		Offset:     int(binary.LittleEndian.Uint32(buf[156:160])),
+		Preferred:  int(binary.LittleEndian.Uint32(buf[4:8])),
+		DetectedBy: ALIGNMENT_STATX,
+	}, nil
+}
@@ -0,0 +1,54 @@
+package data
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/devisions/go-playground/go-directio/codec"
+	"github.com/pkg/errors"
+)
+
+// ID of the binary codec of SomeData.
+const BinaryCodecID = 3
+
+// Codecs returns the codecs that can be used for SomeData.
+func Codecs() []codec.Codec[SomeData] {
+	return []codec.Codec[SomeData]{codec.Gob[SomeData]{}, codec.JSON[SomeData]{}, BinaryCodec{}}
+}
+
+// CodecByName returns the codec of SomeData having the provided name: gob, json or binary.
+func CodecByName(name string) (codec.Codec[SomeData], error) {
+	for _, c := range Codecs() {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("unknown codec '%s'", name))
+}
+
+// BinaryCodec is a compact, hand-written, codec: the length of `Text` (uvarint),
+// the bytes of `Text` and then the 8 bytes (little-endian) of `Number`.
+type BinaryCodec struct{}
+
+func (BinaryCodec) ID() byte     { return BinaryCodecID }
+func (BinaryCodec) Name() string { return "binary" }
+
+func (BinaryCodec) Encode(d SomeData) ([]byte, error) {
+	ed := make([]byte, binary.MaxVarintLen64+len(d.Text)+8)
+	n := binary.PutUvarint(ed, uint64(len(d.Text)))
+	n += copy(ed[n:], d.Text)
+	n += copy(ed[n:], I64toBytes(d.Number))
+	return ed[:n], nil
+}
+
+func (BinaryCodec) Decode(from []byte) (SomeData, error) {
+	l, n := binary.Uvarint(from)
+	if n <= 0 || l > uint64(len(from)) || uint64(len(from)-n) != l+8 {
+		return SomeData{}, errors.New("decoding data: invalid length")
+	}
+	text := from[n : n+int(l)]
+	return SomeData{
+		Text:   string(text),
+		Number: BytesToI64(from[n+int(l):]),
+	}, nil
+}
@@ -4,16 +4,17 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/ncw/directio"
 	"github.com/pkg/errors"
 )
 
-func OpenFileForWriting(filepath string, append bool) (*os.File, error) {
-	mode := os.O_CREATE | os.O_WRONLY
+// OpenFileForWriting opens the file using O_DIRECT (unless its path uses buffered I/O, see `UseBufferedIO`).
+// The `flags` are added to the ones used for opening (ex: O_DSYNC).
+func OpenFileForWriting(filepath string, append bool, flags int) (*os.File, error) {
+	mode := os.O_CREATE | os.O_WRONLY | flags
 	if append {
 		mode = mode | os.O_APPEND
 	}
-	f, err := directio.OpenFile(filepath, mode, 0665)
+	f, err := openFile(filepath, mode)
 	if err != nil {
 		return nil, errors.Wrap(err, fmt.Sprintf("while opening file %s for writing", filepath))
 	}
@@ -26,33 +27,24 @@ func OpenFileForWriting(filepath string, append bool) (*os.File, error) {
 	return f, nil
 }
 
-func OpenFileForReading(filepath string) (*os.File, error) {
-	f, err := directio.OpenFile(filepath, os.O_RDONLY, 0665)
+// OpenExistingFileForWriting opens the file like `OpenFileForWriting` does, without creating it.
+// It returns an error that satisfies `os.IsNotExist` (once unwrapped) if the file does not exist.
+func OpenExistingFileForWriting(filepath string) (*os.File, error) {
+	f, err := openFile(filepath, os.O_WRONLY)
 	if err != nil {
-		_ = f.Close()
-		return nil, errors.Wrap(err, fmt.Sprintf("while opening file %s for reading", filepath))
+		return nil, errors.Wrap(err, fmt.Sprintf("while opening file %s for writing", filepath))
 	}
 	return f, nil
 }
 
-func DeleteFileIfReachedMaxSize(filepath string, maxSize int64) (bool, error) {
-	f, err := OpenFileForReading(filepath)
-	defer func() { _ = f.Close() }()
-	if err != nil {
-		if !os.IsNotExist(errors.Cause(err)) {
-			return false, err
-		}
-		return false, nil
-	}
-	fi, err := f.Stat()
+// OpenFileForReading opens the file using O_DIRECT (unless its path uses buffered I/O, see `UseBufferedIO`).
+func OpenFileForReading(filepath string) (*os.File, error) {
+	f, err := openFile(filepath, os.O_RDONLY)
 	if err != nil {
-		return false, errors.Wrap(err, "trying to get file stat")
-	}
-	if fi.Size() >= maxSize {
-		err := DeleteFile(filepath)
-		return true, errors.Wrap(err, "deleting file "+filepath)
+		_ = f.Close()
+		return nil, errors.Wrap(err, fmt.Sprintf("while opening file %s for reading", filepath))
 	}
-	return false, nil
+	return f, nil
 }
 
 func DeleteFile(filepath string) error {
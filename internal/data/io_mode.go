@@ -0,0 +1,75 @@
+package data
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+
+	"github.com/ncw/directio"
+	"github.com/pkg/errors"
+)
+
+// Modes of doing I/O on the files of a path.
+const (
+	// Direct I/O (O_DIRECT), bypassing the page cache.
+	IO_MODE_DIRECT = "direct"
+	// Buffered I/O, through the page cache, for the file systems that do not support O_DIRECT (ex: tmpfs).
+	IO_MODE_BUFFERED = "buffered"
+)
+
+// The paths whose files are opened using buffered I/O. It is a property of their file system,
+// so it is shared by all the writers and readers of a process.
+var bufferedPaths sync.Map
+
+// UseBufferedIO makes the files of the path be opened using buffered I/O, instead of direct I/O.
+func UseBufferedIO(dir string) {
+	bufferedPaths.Store(path.Clean(dir), true)
+}
+
+// IOModeOf returns the I/O mode that the file gets opened with, according to its path.
+func IOModeOf(filepath string) string {
+	if _, found := bufferedPaths.Load(path.Dir(filepath)); found {
+		return IO_MODE_BUFFERED
+	}
+	return IO_MODE_DIRECT
+}
+
+// openFile opens the file using direct I/O, unless its path uses buffered I/O.
+func openFile(filepath string, flag int) (*os.File, error) {
+	if IOModeOf(filepath) == IO_MODE_BUFFERED {
+		return os.OpenFile(filepath, flag, 0665)
+	}
+	return directio.OpenFile(filepath, flag, 0665)
+}
+
+// ProbeDirectIO tells if the file system of the path supports O_DIRECT, by writing and reading back
+// a block of `blocksize` bytes using a temporary file. It returns an error if O_DIRECT is supported,
+// but the block cannot be written (ex: `blocksize` is not a multiple of the required alignment).
+func ProbeDirectIO(dir string, blocksize int) (bool, error) {
+	tmp, err := os.CreateTemp(dir, ".directio-probe-*")
+	if err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("creating a probe file in path '%s'", dir))
+	}
+	filepath := tmp.Name()
+	_ = tmp.Close()
+	defer func() { _ = os.Remove(filepath) }()
+
+	f, err := directio.OpenFile(filepath, os.O_RDWR, 0665)
+	if errors.Is(err, syscall.EINVAL) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("opening the probe file %s", filepath))
+	}
+	defer func() { _ = f.Close() }()
+	block := directio.AlignedBlock(blocksize)
+	if _, err := f.Write(block); err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("writing a block of %d bytes to the probe file %s using O_DIRECT", blocksize, filepath))
+	}
+	if _, err := f.ReadAt(block, 0); err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("reading a block of %d bytes from the probe file %s using O_DIRECT", blocksize, filepath))
+	}
+	return true, nil
+}
@@ -0,0 +1,31 @@
+//go:build linux && (amd64 || arm64)
+
+package data
+
+import (
+	"os"
+	"syscall"
+)
+
+// The advice of posix_fadvise telling that the data is not going to be accessed in the near future.
+const fadvDontNeed = 4
+
+// SyncData syncs the data of the file (using fdatasync), along with the metadata needed for reading it (ex: its size).
+func SyncData(f *os.File) error {
+	for {
+		err := syscall.Fdatasync(int(f.Fd()))
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+// DropPageCache drops the (clean) pages of the file from the page cache (using posix_fadvise),
+// so that buffered I/O does not fill it with data that is not accessed again soon.
+func DropPageCache(f *os.File) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), 0, 0, fadvDontNeed, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
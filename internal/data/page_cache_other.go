@@ -0,0 +1,15 @@
+//go:build !linux || !(amd64 || arm64)
+
+package data
+
+import "os"
+
+// SyncData syncs the file, as fdatasync is used only on Linux.
+func SyncData(f *os.File) error {
+	return f.Sync()
+}
+
+// DropPageCache is supported only on Linux.
+func DropPageCache(f *os.File) error {
+	return nil
+}
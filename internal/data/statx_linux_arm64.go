@@ -0,0 +1,4 @@
+package data
+
+// The number of the statx system call.
+const sysStatx = 291
@@ -0,0 +1,118 @@
+// Package ioengine provides the engines that do the (positional) reads and writes of the blocks of the files of a queue.
+package ioengine
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Names of the engines.
+const (
+	// Blocking reads and writes, one per buffer (the buffers adjacent in memory being merged),
+	// using `os.File.ReadAt` and `os.File.WriteAt` (pread and pwrite).
+	ENGINE_SYNC = "sync"
+	// Positional vectored reads and writes: all the buffers in a single preadv or pwritev.
+	ENGINE_PWRITEV = "pwritev"
+	// io_uring, keeping several reads or writes (of up to `chunkSize` bytes, the buffers adjacent in memory being merged) in flight.
+	ENGINE_IO_URING = "io_uring"
+)
+
+// Engine reads and writes the blocks of the files, at the provided positions.
+// When used with files opened using direct I/O, the buffers must be aligned (see `directio.AlignedBlock`)
+// and their lengths and the positions must be multiples of the block size.
+// The buffers are usually the blocks of a bigger buffer (one I/O vector per block), so the engines that do
+// a call per buffer merge the ones adjacent in memory.
+// An engine that fails without knowing if the kernel still uses the buffers (ex: io_uring) fails every later read or write.
+// An Engine is not safe for concurrent use.
+type Engine interface {
+	Name() string
+	// WriteAt writes the buffers, one after the other, starting at position `off` of the file.
+	WriteAt(f *os.File, bufs [][]byte, off int64) error
+	// ReadAt reads into the buffers, one after the other, starting at position `off` of the file.
+	// It returns the number of bytes read, that is less than the buffers' length only if the file ends before.
+	ReadAt(f *os.File, bufs [][]byte, off int64) (int, error)
+	// Close releases the resources of the engine. It cannot be used after being closed.
+	Close() error
+}
+
+// New returns the engine having the provided name: sync, pwritev or io_uring.
+// The `depth` is the maximum number of reads or writes that io_uring keeps in flight.
+// It fails if the engine is not supported (ex: io_uring is disabled by the kernel).
+func New(name string, depth int) (Engine, error) {
+	switch name {
+	case ENGINE_SYNC:
+		return Sync{}, nil
+	case ENGINE_PWRITEV:
+		return newVectored()
+	case ENGINE_IO_URING:
+		if depth <= 0 {
+			return nil, errors.New(fmt.Sprintf("invalid io_uring queue depth %d", depth))
+		}
+		return newIOUring(depth)
+	}
+	return nil, errors.New(fmt.Sprintf("unknown I/O engine '%s'", name))
+}
+
+// Sync is the engine doing blocking reads and writes, one per buffer (the buffers adjacent in memory being merged).
+// It is stateless, so it can be used without being created using `New`.
+type Sync struct{}
+
+func (Sync) Name() string { return ENGINE_SYNC }
+
+func (Sync) WriteAt(f *os.File, bufs [][]byte, off int64) error {
+	for len(bufs) > 0 {
+		var b []byte
+		b, bufs = merge(bufs)
+		if _, err := f.WriteAt(b, off); err != nil {
+			return err
+		}
+		off += int64(len(b))
+	}
+	return nil
+}
+
+func (Sync) ReadAt(f *os.File, bufs [][]byte, off int64) (int, error) {
+	read := 0
+	for len(bufs) > 0 {
+		var b []byte
+		b, bufs = merge(bufs)
+		n, err := f.ReadAt(b, off)
+		read += n
+		if err == io.EOF {
+			return read, nil
+		}
+		if err != nil {
+			return read, err
+		}
+		off += int64(n)
+	}
+	return read, nil
+}
+
+func (Sync) Close() error { return nil }
+
+// merge returns the first buffer, extended over the buffers that follow it in memory, and the buffers left after these.
+func merge(bufs [][]byte) ([]byte, [][]byte) {
+	b, i := bufs[0], 1
+	for ; i < len(bufs) && adjacent(b, bufs[i]); i++ {
+		b = b[:len(b)+len(bufs[i])]
+	}
+	return b, bufs[i:]
+}
+
+// adjacent tells if `b` starts right where `a` ends, in the same memory (ex: they are consecutive blocks of a buffer).
+func adjacent(a, b []byte) bool {
+	return len(b) > 0 && cap(a)-len(a) >= len(b) && &a[:len(a)+1][len(a)] == &b[0]
+}
+
+// length returns the total length of the buffers.
+func length(bufs [][]byte) int {
+	n := 0
+	for _, b := range bufs {
+		n += len(b)
+	}
+	return n
+}
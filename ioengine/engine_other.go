@@ -0,0 +1,15 @@
+//go:build !linux || !(amd64 || arm64)
+
+package ioengine
+
+import "github.com/pkg/errors"
+
+// newVectored is supported only on Linux.
+func newVectored() (Engine, error) {
+	return nil, errors.New("the pwritev I/O engine is supported only on Linux")
+}
+
+// newIOUring is supported only on Linux.
+func newIOUring(depth int) (Engine, error) {
+	return nil, errors.New("the io_uring I/O engine is supported only on Linux")
+}
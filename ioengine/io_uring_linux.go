@@ -0,0 +1,319 @@
+//go:build linux && (amd64 || arm64)
+
+package ioengine
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// The io_uring system calls (having the same numbers on amd64 and arm64).
+const (
+	sysIOUringSetup = 425
+	sysIOUringEnter = 426
+)
+
+// The offsets of mapping the submission queue ring, the completion queue ring and the submission queue entries.
+const (
+	ioringOffSQRing = 0
+	ioringOffCQRing = 0x8000000
+	ioringOffSQEs   = 0x10000000
+)
+
+// The io_uring_enter flag for waiting for completions.
+const ioringEnterGetEvents = 1
+
+// The io_uring operations used: read and write (available since Linux 5.6).
+const (
+	ioringOpRead  = 22
+	ioringOpWrite = 23
+)
+
+// The size of the largest read or write submitted. The bigger buffers get split, so that their parts are in flight together.
+const chunkSize = 64 * 1024
+
+// The offsets of the fields of the submission queue ring (struct io_sqring_offsets).
+type sqringOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+// The offsets of the fields of the completion queue ring (struct io_cqring_offsets).
+type cqringOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+// The parameters of io_uring_setup (struct io_uring_params).
+type uringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  sqringOffsets
+	cqOff                                                                  cqringOffsets
+}
+
+// A submission queue entry (struct io_uring_sqe), as used for reads and writes.
+type submission struct {
+	opcode   uint8
+	flags    uint8
+	ioprio   uint16
+	fd       int32
+	off      uint64
+	addr     uint64
+	len      uint32
+	rwFlags  uint32
+	userData uint64
+	pad      [3]uint64
+}
+
+// A completion queue entry (struct io_uring_cqe).
+type completion struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// uringOp is a read or a write of (a chunk of) a buffer.
+type uringOp struct {
+	buf []byte
+	off int64
+	// Bytes read or written.
+	done int
+}
+
+// ioUring is the engine doing the reads and writes using io_uring, keeping up to `depth` of them in flight.
+type ioUring struct {
+	fd    int
+	depth int
+
+	// The memory shared with the kernel.
+	sqRing []byte
+	cqRing []byte
+	sqMem  []byte
+
+	// The submission queue.
+	sqHead *uint32
+	sqTail *uint32
+	sqMask uint32
+	sqes   []submission
+
+	// The completion queue.
+	cqHead *uint32
+	cqTail *uint32
+	cqMask uint32
+	cqes   []completion
+
+	// The operations (re)used for each call.
+	ops []uringOp
+
+	// The error of submitting to io_uring or waiting for the completions, that makes the engine unusable: the kernel might
+	// still use the memory of the ops in flight (kept in `ops`), so every later read or write fails with it.
+	broken error
+}
+
+func newIOUring(depth int) (Engine, error) {
+	var p uringParams
+	fd, _, errno := syscall.Syscall(sysIOUringSetup, uintptr(depth), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, errors.Wrap(os.NewSyscallError("io_uring_setup", errno), fmt.Sprintf("setting up io_uring with %d entries", depth))
+	}
+	u := &ioUring{fd: int(fd), depth: depth}
+	if u.depth > int(p.sqEntries) {
+		u.depth = int(p.sqEntries)
+	}
+	if err := u.mapRings(&p); err != nil {
+		_ = u.Close()
+		return nil, errors.Wrap(err, "mapping the io_uring rings")
+	}
+	return u, nil
+}
+
+// mapRings maps the rings and the submission queue entries into memory.
+func (u *ioUring) mapRings(p *uringParams) error {
+	var err error
+	mmap := func(offset int64, size int) ([]byte, error) {
+		return syscall.Mmap(u.fd, offset, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	}
+	if u.sqRing, err = mmap(ioringOffSQRing, int(p.sqOff.array+p.sqEntries*4)); err != nil {
+		return err
+	}
+	if u.cqRing, err = mmap(ioringOffCQRing, int(p.cqOff.cqes+p.cqEntries*uint32(unsafe.Sizeof(completion{})))); err != nil {
+		return err
+	}
+	if u.sqMem, err = mmap(ioringOffSQEs, int(p.sqEntries*uint32(unsafe.Sizeof(submission{})))); err != nil {
+		return err
+	}
+	u.sqHead = (*uint32)(unsafe.Pointer(&u.sqRing[p.sqOff.head]))
+	u.sqTail = (*uint32)(unsafe.Pointer(&u.sqRing[p.sqOff.tail]))
+	u.sqMask = *(*uint32)(unsafe.Pointer(&u.sqRing[p.sqOff.ringMask]))
+	u.sqes = unsafe.Slice((*submission)(unsafe.Pointer(&u.sqMem[0])), p.sqEntries)
+	// Each entry of the ring is the submission queue entry having the same index.
+	array := unsafe.Slice((*uint32)(unsafe.Pointer(&u.sqRing[p.sqOff.array])), p.sqEntries)
+	for i := range array {
+		array[i] = uint32(i)
+	}
+	u.cqHead = (*uint32)(unsafe.Pointer(&u.cqRing[p.cqOff.head]))
+	u.cqTail = (*uint32)(unsafe.Pointer(&u.cqRing[p.cqOff.tail]))
+	u.cqMask = *(*uint32)(unsafe.Pointer(&u.cqRing[p.cqOff.ringMask]))
+	u.cqes = unsafe.Slice((*completion)(unsafe.Pointer(&u.cqRing[p.cqOff.cqes])), p.cqEntries)
+	return nil
+}
+
+func (*ioUring) Name() string { return ENGINE_IO_URING }
+
+func (u *ioUring) WriteAt(f *os.File, bufs [][]byte, off int64) error {
+	return u.run(ioringOpWrite, f, bufs, off)
+}
+
+func (u *ioUring) ReadAt(f *os.File, bufs [][]byte, off int64) (int, error) {
+	if err := u.run(ioringOpRead, f, bufs, off); err != nil {
+		return 0, err
+	}
+	// The bytes read up to the first short read: where the file ends.
+	read := 0
+	for _, op := range u.ops {
+		read += op.done
+		if op.done < len(op.buf) {
+			break
+		}
+	}
+	return read, nil
+}
+
+func (u *ioUring) Close() error {
+	for _, m := range [][]byte{u.sqMem, u.cqRing, u.sqRing} {
+		if m != nil {
+			_ = syscall.Munmap(m)
+		}
+	}
+	u.sqMem, u.cqRing, u.sqRing = nil, nil, nil
+	return syscall.Close(u.fd)
+}
+
+// run splits the buffers into chunks of up to `chunkSize` bytes (merging the buffers adjacent in memory) and reads or
+// writes them (according to the `opcode`), keeping up to `depth` of them in flight. A short write gets continued, while a short read (the end of the file) does not.
+// It returns only once all the submitted chunks are completed, as the kernel uses their memory until then.
+// If that cannot be known (see `ioUring.broken`), the engine fails from then on.
+func (u *ioUring) run(opcode uint8, f *os.File, bufs [][]byte, off int64) error {
+	if u.broken != nil {
+		return errors.Wrap(u.broken, "io_uring failed before")
+	}
+	u.ops = u.ops[:0]
+	for _, b := range bufs {
+		for len(b) > 0 {
+			last := len(u.ops) - 1
+			if last >= 0 && len(u.ops[last].buf) < chunkSize && adjacent(u.ops[last].buf, b) {
+				// The buffer continues the previous chunk.
+				n := chunkSize - len(u.ops[last].buf)
+				if n > len(b) {
+					n = len(b)
+				}
+				u.ops[last].buf = u.ops[last].buf[:len(u.ops[last].buf)+n]
+				b = b[n:]
+				off += int64(n)
+				continue
+			}
+			n := len(b)
+			if n > chunkSize {
+				n = chunkSize
+			}
+			u.ops = append(u.ops, uringOp{buf: b[:n], off: off})
+			b = b[n:]
+			off += int64(n)
+		}
+	}
+	fd := int32(f.Fd())
+	var err error
+	// The ops after `next` are not submitted yet, besides the continuations of the short writes, that are appended.
+	next, inFlight := 0, 0
+	for len(u.ops) > next || inFlight > 0 {
+		submit := 0
+		for err == nil && next < len(u.ops) && inFlight < u.depth {
+			u.prepare(opcode, fd, next)
+			next++
+			inFlight++
+			submit++
+		}
+		// Waiting for a single completion keeps the queue full, while the last ones get waited for together.
+		wait := 1
+		if next == len(u.ops) {
+			wait = inFlight
+		}
+		if eerr := u.enter(submit, wait); eerr != nil {
+			u.broken = errors.Wrap(eerr, "submitting to io_uring")
+			return u.broken
+		}
+		for head, tail := *u.cqHead, atomic.LoadUint32(u.cqTail); head != tail; head++ {
+			c := u.cqes[head&u.cqMask]
+			inFlight--
+			op := &u.ops[c.userData]
+			switch {
+			case c.res < 0:
+				if err == nil {
+					err = syscall.Errno(-c.res)
+				}
+			case opcode == ioringOpWrite && int(c.res) < len(op.buf):
+				op.done = int(c.res)
+				if c.res == 0 && err == nil {
+					err = io.ErrShortWrite
+				}
+				// Appending might move the ops, so `op` is not used after.
+				u.ops = append(u.ops, uringOp{buf: op.buf[c.res:], off: op.off + int64(c.res)})
+			default:
+				op.done = int(c.res)
+			}
+			atomic.StoreUint32(u.cqHead, head+1)
+		}
+		if err != nil {
+			next = len(u.ops) // Nothing else gets submitted.
+		}
+	}
+	runtime.KeepAlive(bufs)
+	runtime.KeepAlive(f)
+	if err != nil {
+		if opcode == ioringOpWrite {
+			return errors.Wrap(err, "writing using io_uring")
+		}
+		return errors.Wrap(err, "reading using io_uring")
+	}
+	return nil
+}
+
+// prepare fills the next submission queue entry, for the op having index `i`, and makes it visible to the kernel.
+func (u *ioUring) prepare(opcode uint8, fd int32, i int) {
+	op := &u.ops[i]
+	tail := *u.sqTail
+	u.sqes[tail&u.sqMask] = submission{
+		opcode:   opcode,
+		fd:       fd,
+		off:      uint64(op.off),
+		addr:     uint64(uintptr(unsafe.Pointer(&op.buf[0]))),
+		len:      uint32(len(op.buf)),
+		userData: uint64(i),
+	}
+	atomic.StoreUint32(u.sqTail, tail+1)
+}
+
+// enter submits the prepared entries and waits for at least `wait` completions, retrying if interrupted.
+func (u *ioUring) enter(submit, wait int) error {
+	for {
+		n, _, errno := syscall.Syscall6(sysIOUringEnter, uintptr(u.fd), uintptr(submit), uintptr(wait), ioringEnterGetEvents, 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return os.NewSyscallError("io_uring_enter", errno)
+		}
+		if int(n) >= submit {
+			return nil
+		}
+		submit -= int(n)
+	}
+}
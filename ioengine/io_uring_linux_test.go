@@ -0,0 +1,44 @@
+//go:build linux && (amd64 || arm64)
+
+package ioengine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestIOUringBroken makes submitting to io_uring fail and then checks that the engine fails every later read or write,
+// even once submitting works again.
+func TestIOUringBroken(t *testing.T) {
+	e, err := New(ENGINE_IO_URING, 4)
+	if err != nil {
+		t.Skip("io_uring is not supported:", err)
+	}
+	u := e.(*ioUring)
+	f, err := os.Create(filepath.Join(t.TempDir(), "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	bufs := [][]byte{make([]byte, 4096), make([]byte, 4096)}
+	if err := e.WriteAt(f, bufs, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	fd := u.fd
+	u.fd = -1 // So that io_uring_enter fails (EBADF).
+	if err := e.WriteAt(f, bufs, 0); err == nil {
+		t.Fatal("writing using an invalid io_uring succeeded")
+	}
+	u.fd = fd
+	if err := e.WriteAt(f, bufs, 0); err == nil {
+		t.Fatal("writing succeeded after io_uring failed")
+	}
+	if _, err := e.ReadAt(f, bufs, 0); err == nil {
+		t.Fatal("reading succeeded after io_uring failed")
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
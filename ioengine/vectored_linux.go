@@ -0,0 +1,103 @@
+//go:build linux && (amd64 || arm64)
+
+package ioengine
+
+import (
+	"io"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// The maximum number of buffers of a single preadv or pwritev (IOV_MAX).
+const maxIovecs = 1024
+
+// vectored is the engine doing positional vectored reads and writes (preadv and pwritev).
+type vectored struct {
+	// The I/O vectors (re)used for each call.
+	iovecs []syscall.Iovec
+}
+
+func newVectored() (Engine, error) {
+	return &vectored{}, nil
+}
+
+func (*vectored) Name() string { return ENGINE_PWRITEV }
+
+func (v *vectored) WriteAt(f *os.File, bufs [][]byte, off int64) error {
+	for left := length(bufs); left > 0; {
+		n, err := v.call(syscall.SYS_PWRITEV, f, bufs, off)
+		if err != nil {
+			return os.NewSyscallError("pwritev", err)
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		bufs = advance(bufs, n)
+		off += int64(n)
+		left -= n
+	}
+	return nil
+}
+
+func (v *vectored) ReadAt(f *os.File, bufs [][]byte, off int64) (int, error) {
+	read := 0
+	for left := length(bufs); left > 0; {
+		n, err := v.call(syscall.SYS_PREADV, f, bufs, off)
+		if err != nil {
+			return read, os.NewSyscallError("preadv", err)
+		}
+		if n == 0 { // The end of the file.
+			break
+		}
+		bufs = advance(bufs, n)
+		off += int64(n)
+		left -= n
+		read += n
+	}
+	return read, nil
+}
+
+func (v *vectored) Close() error { return nil }
+
+// call does a single preadv or pwritev (the `trap`) of (up to `maxIovecs` of) the buffers, retrying it if interrupted.
+func (v *vectored) call(trap uintptr, f *os.File, bufs [][]byte, off int64) (int, error) {
+	v.iovecs = v.iovecs[:0]
+	for _, b := range bufs {
+		if len(v.iovecs) == maxIovecs {
+			break
+		}
+		if len(b) == 0 {
+			continue
+		}
+		iov := syscall.Iovec{Base: &b[0]}
+		iov.SetLen(len(b))
+		v.iovecs = append(v.iovecs, iov)
+	}
+	for {
+		// On 64 bits, the position is passed as its low part, with a zero high part.
+		n, _, errno := syscall.Syscall6(trap, f.Fd(), uintptr(unsafe.Pointer(&v.iovecs[0])), uintptr(len(v.iovecs)), uintptr(off), 0, 0)
+		runtime.KeepAlive(bufs)
+		runtime.KeepAlive(f)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return 0, errno
+		}
+		return int(n), nil
+	}
+}
+
+// advance returns the buffers left after the first `n` bytes, without changing `bufs`.
+func advance(bufs [][]byte, n int) [][]byte {
+	for len(bufs) > 0 && n >= len(bufs[0]) {
+		n -= len(bufs[0])
+		bufs = bufs[1:]
+	}
+	if n == 0 {
+		return bufs
+	}
+	return append([][]byte{bufs[0][n:]}, bufs[1:]...)
+}
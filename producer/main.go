@@ -13,71 +13,70 @@ import (
 	"github.com/devisions/go-playground/go-directio/config"
 	"github.com/devisions/go-playground/go-directio/internal/data"
 	"github.com/devisions/go-playground/go-directio/producer/internal"
-	"github.com/ncw/directio"
-	"github.com/pkg/errors"
-)
-
-var (
-	// The block (re)used for writing.
-	block []byte
-
-	// Size of the `block`.
-	blocksize int
-
-	// Path where the files are written.
-	filepathPrefix string
-
-	// Maximum size of a file to write into.
-	fileMaxsize int64
-
-	// The current file to write into.
-	out *os.File
+	"github.com/devisions/go-playground/go-directio/queue"
 )
 
 func main() {
 	// Setting up the graceful shutdown elements.
 	stopCtx, cancelFn := context.WithCancel(context.Background())
 	stopWg := &sync.WaitGroup{}
-	stopWg.Add(2)
+	stopWg.Add(3)
 
 	cfg, err := config.Load()
 	if err != nil {
 		log.Fatal("Failed to load config", err)
 	}
 
-	if done, err := data.MakePathIfNotExists(cfg.Path); err != nil {
-		log.Fatalf("Failed to create (missing) path '%s' for writing files into. Reason: %s\n", cfg.Path, err)
-	} else if done {
-		log.Println("Created the (missing) path", cfg.Path)
+	w, err := queue.NewWriter(cfg)
+	if err != nil {
+		log.Fatalln("Failed to init the writer. Reason:", err)
+	}
+	log.Printf("Using a %d bytes block and %s I/O (%s engine), writing files in path %s\n", w.Blocksize(), w.IOMode(), w.Engine(), cfg.Path)
+	log.Println("Ready to write on file", w.Name())
+	log.Printf("Using the sync policy %+v\n", w.SyncPolicy())
+	if cfg.ProducerBatchRecords > 1 || w.BufferSize() > w.Blocksize() {
+		log.Printf("Appending groups of up to %d records (lingering %s for them), using a %d bytes write buffer\n",
+			cfg.ProducerBatchRecords, cfg.ProducerLinger, w.BufferSize())
+	}
+	if cfg.RecycleSegments > 0 {
+		log.Printf("Preallocating the files to %d bytes and recycling up to %d of them\n", cfg.MaxFileSizeBytes, cfg.RecycleSegments)
+	} else if cfg.Preallocate {
+		log.Printf("Preallocating the files to %d bytes\n", cfg.MaxFileSizeBytes)
 	}
 
-	block = directio.AlignedBlock(cfg.BlockSize)
-	blocksize = len(block)
-	filepathPrefix = cfg.Path
-	fileMaxsize = cfg.MaxFileSizeBytes
-	log.Printf("Using a %d bytes block, writing files in path %s\n", len(block), cfg.Path)
+	c, err := data.CodecByName(cfg.Codec)
+	if err != nil {
+		log.Fatalln("Failed to use the codec. Reason:", err)
+	}
+	q, err := queue.NewQueue(w, nil, c)
+	if err != nil {
+		log.Fatalln("Failed to init the queue. Reason:", err)
+	}
+	log.Println("Encoding data using codec", c.Name())
 
 	dataCh := make(chan data.SomeData, 1_000_000)
 	defer close(dataCh)
 
-	go writer(dataCh, stopCtx, stopWg)
+	cl := queue.NewCleaner(cfg)
+	log.Printf("Using the retention policy %+v\n", cl.Policy())
+	if cfg.ArchivePath != "" {
+		log.Printf("Archiving the files into path %s (compressed: %t), using the retention policy %+v\n", cfg.ArchivePath, cfg.ArchiveCompress, cl.ArchivePolicy())
+	}
+
+	go writer(w, q, dataCh, cfg.ProducerBatchRecords, cfg.ProducerLinger, stopCtx, stopWg)
 	go producer(dataCh, stopCtx, stopWg)
+	go cleaner(cl, cfg.RetentionCheckInterval, stopCtx, stopWg)
 
 	waitingForGracefulShutdown(cancelFn, stopWg)
 }
 
-func writer(dataCh chan data.SomeData, stopCtx context.Context, stopWg *sync.WaitGroup) {
-
-	f, err := internal.GetInitialFileForWriting(filepathPrefix, fileMaxsize)
-	if err != nil {
-		log.Fatalln("Failed to look for the next file to write into. Reason:", err)
-	}
-	if f == nil { // This should never happen; used just for safety.
-		log.Fatalln("No file to write could be used.")
-	}
-	out = f
-	log.Println("Ready to write on file", out.Name())
+// How often the writer logs its stats (the writes, by I/O mode, and the sync latency), while there is nothing to write.
+const statsLogInterval = 10 * time.Second
 
+// writer appends the queued data, grouping up to `batchRecords` of them (see `nextBatch`), so that they get written together.
+func writer(w *queue.Writer, q *queue.Queue[data.SomeData], dataCh chan data.SomeData, batchRecords int, linger time.Duration,
+	stopCtx context.Context, stopWg *sync.WaitGroup) {
+	lastStatsLog := time.Now()
 	running := true
 	for running {
 		select {
@@ -88,28 +87,40 @@ func writer(dataCh chan data.SomeData, stopCtx context.Context, stopWg *sync.Wai
 				log.Printf("Draining the channel: writing to file the remaining %d data items ...", l)
 				for len(dataCh) > 0 {
 					d := <-dataCh
-					if err := write(filepathPrefix, fileMaxsize, &d); err != nil {
+					if err := q.Write(d); err != nil {
 						log.Println("Failed writing to file. Reason:", err)
 						break
 					}
 				}
 			}
-			if out != nil { // Just for safety reasons.
-				err := out.Close()
-				if err != nil {
-					log.Printf("Failed closing the file. Reason: %s", err)
-				}
+			if err := w.Close(); err != nil {
+				log.Printf("Failed closing the file. Reason: %s", err)
 			}
+			log.Println("I/O:", w.IOStats())
+			log.Println("Sync latency:", w.SyncStats())
 
 			running = false
 			break
 		case d := <-dataCh:
-			if err := write(filepathPrefix, fileMaxsize, &d); err != nil {
+			if err := q.WriteBatch(nextBatch(d, dataCh, batchRecords, linger)); err != nil {
 				log.Println("Failed writing to file. Reason:", err)
 				running = false
 				break
 			}
 		default:
+			// Nothing else to write for now, so let's write the pending block.
+			if err := w.Flush(); err != nil {
+				log.Println("Failed writing to file. Reason:", err)
+				running = false
+				break
+			}
+			if time.Since(lastStatsLog) >= statsLogInterval {
+				log.Println("I/O:", w.IOStats())
+				if w.SyncPolicy().Mode != queue.SYNC_NONE {
+					log.Println("Sync latency:", w.SyncStats())
+				}
+				lastStatsLog = time.Now()
+			}
 			time.Sleep(500 * time.Millisecond)
 		}
 	}
@@ -117,6 +128,36 @@ func writer(dataCh chan data.SomeData, stopCtx context.Context, stopWg *sync.Wai
 	stopWg.Done()
 }
 
+// nextBatch groups the data `first` with the data queued after it, up to `max` of them.
+// If `linger` is positive, it waits up to that long for more data to be queued, until the group is full.
+func nextBatch(first data.SomeData, dataCh chan data.SomeData, max int, linger time.Duration) []data.SomeData {
+	batch := []data.SomeData{first}
+	var timeout <-chan time.Time
+	if linger > 0 {
+		t := time.NewTimer(linger)
+		defer t.Stop()
+		timeout = t.C
+	}
+	for len(batch) < max {
+		if timeout == nil {
+			select {
+			case d := <-dataCh:
+				batch = append(batch, d)
+				continue
+			default:
+				return batch
+			}
+		}
+		select {
+		case d := <-dataCh:
+			batch = append(batch, d)
+		case <-timeout:
+			return batch
+		}
+	}
+	return batch
+}
+
 func producer(dataCh chan data.SomeData, stopCtx context.Context, stopWg *sync.WaitGroup) {
 	var i uint32
 	log.Println("Starting to produce ...")
@@ -142,67 +183,24 @@ func producer(dataCh chan data.SomeData, stopCtx context.Context, stopWg *sync.W
 	stopWg.Done()
 }
 
-func write(filepathPrefix string, fileMaxsize int64, d *data.SomeData) error {
-	ed := d.Encode()
-	edl := len(ed)
-	edlb := data.I64toBytes(uint64(edl))
-	// Encoded data fits into one block.
-	if blocksize >= 8+edl {
-		copy(block, edlb)   // putting first the (bytes of the) encoded data length
-		copy(block[8:], ed) // putting the encoded data
-		if err := writeOut(block); err != nil {
-			return err
-		}
-		log.Printf("[dbg]  chars: %d  edl: %d  wrote: %d  \n", len(d.Text), edl, 8+edl)
-		return nil
-	}
-	// Encoded data must be written in multiple blocks.
-	i := blocksize - 8
-	// Same as one block case, in the 1st block we write the size and then the first part.
-	copy(block, edlb) // putting first the (bytes of the) encoded data length
-	copy(block[8:], ed[:i])
-	if err := writeOut(block); err != nil {
-		return err
-	}
-	log.Printf("[dbg]  chars: %d  edl: %d  wrote: %d  next i: %d\n", len(d.Text), edl, 8+i, i)
-	// Next block(s).
-	for edl-i > 0 {
-		if edl > i+blocksize {
-			copy(block, ed[i:i+blocksize])
-			if err := writeOut(block); err != nil {
-				return err
-			}
-			log.Printf("[dbg]  chars: %d  edl: %d  wrote: %d  next i: %d\n", len(d.Text), edl, 8+i, i+blocksize)
-			i = i + blocksize
-		} else {
-			copy(block, ed[i:])
-			if err := writeOut(block); err != nil {
-				return err
+func cleaner(cl *queue.Cleaner, interval time.Duration, stopCtx context.Context, stopWg *sync.WaitGroup) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	running := true
+	for running {
+		select {
+		case <-stopCtx.Done():
+			log.Println("Stopping the cleaner ...")
+			running = false
+			break
+		case <-ticker.C:
+			if _, err := cl.Clean(); err != nil {
+				log.Println("[WARN] Failed to apply the retention. Reason:", err)
 			}
-			log.Printf("[dbg]  chars: %d  edl: %d  wrote: %d  done.\n", len(d.Text), edl, edl-i)
-			i = edl
 		}
 	}
-	return nil
-}
-
-func writeOut(block []byte) error {
-	f, err := internal.CheckNextFileForWriting(out, filepathPrefix, fileMaxsize)
-	if err != nil {
-		return err
-	}
-	// A new file has been provided, so close existing and start using it.
-	if f != nil {
-		if err := out.Close(); err != nil {
-			log.Printf("[WARN] Failed to close existing file '%s'. Reason:%s\n", out.Name(), err)
-		}
-		log.Println("Writing to new file", f.Name())
-		out = f
-	}
-	if _, err := out.Write(block); err != nil {
-		return errors.Wrap(err, "writing to file")
-	}
-	return nil
+	log.Println("Cleaner stopped.")
+	stopWg.Done()
 }
 
 func waitingForGracefulShutdown(cancelFn context.CancelFunc, stopWg *sync.WaitGroup) {
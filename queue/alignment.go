@@ -0,0 +1,70 @@
+package queue
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/devisions/go-playground/go-directio/config"
+	"github.com/devisions/go-playground/go-directio/internal/data"
+	"github.com/ncw/directio"
+	"github.com/pkg/errors"
+)
+
+// The block size used when it is not configured and the path does not support direct I/O (see `DIRECT_IO_FALLBACK`).
+const fallbackBlocksize = 4096
+
+// The smallest block size that gets derived from the alignment, so that a block holds several record headers.
+const minDerivedBlocksize = 512
+
+// ResolveBlockSize detects the alignment that direct I/O requires on the files of the configured path (that must exist).
+// The configured block size must be a multiple of it. If the block size is 0, it gets set to the preferred I/O size
+// of the file system, if that is a multiple of the alignment, or to the alignment (but at least 512 bytes) otherwise.
+// It also checks that the max file size is positive and a multiple of the block size.
+func ResolveBlockSize(cfg *config.Config) error {
+	a, err := data.DirectIOAlignment(cfg.Path)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("detecting the direct I/O alignment of path '%s'", cfg.Path))
+	}
+	if a != nil && a.Memory > directio.AlignSize {
+		return errors.New(fmt.Sprintf("the direct I/O memory alignment of path '%s' is %d bytes, greater than the %d bytes that the blocks are aligned to",
+			cfg.Path, a.Memory, directio.AlignSize))
+	}
+	if cfg.BlockSize == 0 {
+		cfg.BlockSize = deriveBlocksize(a)
+		if a != nil {
+			log.Printf("Using a block size of %d bytes, for the direct I/O alignment of %d bytes (detected using %s) of path %s\n",
+				cfg.BlockSize, a.Offset, a.DetectedBy, cfg.Path)
+		}
+	}
+	if cfg.BlockSize <= 0 {
+		return errors.New(fmt.Sprintf("%s %d must be positive", config.IO_BLOCK_SIZE, cfg.BlockSize))
+	}
+	if a != nil && cfg.BlockSize%a.Offset != 0 {
+		return errors.New(fmt.Sprintf("%s %d is not a multiple of the direct I/O alignment of %d bytes (detected using %s) of path '%s'",
+			config.IO_BLOCK_SIZE, cfg.BlockSize, a.Offset, a.DetectedBy, cfg.Path))
+	}
+	if cfg.MaxFileSizeBytes <= 0 {
+		return errors.New(fmt.Sprintf("%s %d must be positive", config.IO_MAX_FILE_SIZE_BYTES, cfg.MaxFileSizeBytes))
+	}
+	if cfg.MaxFileSizeBytes%int64(cfg.BlockSize) != 0 {
+		return errors.New(fmt.Sprintf("%s %d is not a multiple of the block size of %d bytes",
+			config.IO_MAX_FILE_SIZE_BYTES, cfg.MaxFileSizeBytes, cfg.BlockSize))
+	}
+	return nil
+}
+
+// deriveBlocksize returns the block size to use for the alignment `a` (nil if direct I/O is not supported).
+func deriveBlocksize(a *data.Alignment) int {
+	if a == nil {
+		return fallbackBlocksize
+	}
+	bs := a.Offset
+	if a.Preferred > 0 && a.Preferred%a.Offset == 0 {
+		bs = a.Preferred
+	}
+	if bs < minDerivedBlocksize {
+		// Alignments are powers of 2, so the minimum is a multiple of the alignment.
+		bs = minDerivedBlocksize
+	}
+	return bs
+}
@@ -0,0 +1,99 @@
+package queue
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/devisions/go-playground/go-directio/internal/data"
+	"github.com/pkg/errors"
+)
+
+// Extension added to the name of an archived file (aka segment) that is compressed (ex: 00000000000000001024.dat.gz).
+const COMPRESSED_EXT = ".gz"
+
+// archiveSegment moves the file (aka segment) and its indexes into `archivePath`, compressing the file if asked to.
+// It returns the path of the archived file.
+func archiveSegment(segmentFilepath string, archivePath string, compress bool) (string, error) {
+	if done, err := data.MakePathIfNotExists(archivePath); err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("creating (missing) archive path '%s'", archivePath))
+	} else if done {
+		log.Println("Created the (missing) archive path", archivePath)
+	}
+	// The indexes are moved first, so that a reader never finds an archived file without them.
+	// Anyway, a missing index gets rebuilt when needed.
+	for _, fp := range []string{indexFilepath(segmentFilepath), timeIndexFilepath(segmentFilepath)} {
+		if err := moveFile(fp, archivePath+string(os.PathSeparator)+path.Base(fp), false); err != nil && !os.IsNotExist(errors.Cause(err)) {
+			return "", err
+		}
+	}
+	to := archivePath + string(os.PathSeparator) + path.Base(segmentFilepath)
+	if compress {
+		to += COMPRESSED_EXT
+	}
+	if err := moveFile(segmentFilepath, to, compress); err != nil {
+		return "", err
+	}
+	// The age of an archived file counts from the moment it got archived.
+	now := time.Now()
+	if err := os.Chtimes(to, now, now); err != nil {
+		log.Printf("[WARN] Failed to update the modification time of file '%s'. Reason: %s\n", to, err)
+	}
+	return to, nil
+}
+
+// moveFile moves the file `from` as `to`. If `compress` is true, or if a rename is not possible
+// (ex: `to` is on another file system), the content is copied (and compressed) first.
+func moveFile(from string, to string, compress bool) error {
+	if !compress {
+		err := os.Rename(from, to)
+		if linkErr, ok := err.(*os.LinkError); !ok || linkErr.Err != syscall.EXDEV {
+			return err
+		}
+	}
+	if err := copyFile(from, to, compress); err != nil {
+		return err
+	}
+	return data.DeleteFile(from)
+}
+
+// copyFile copies (and, optionally, compresses) the file `from` as `to`, which appears only once completely written.
+func copyFile(from string, to string, compress bool) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+	tmp := to + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("creating file %s", tmp))
+	}
+	var w io.WriteCloser = out
+	if compress {
+		w = gzip.NewWriter(out)
+	}
+	_, err = io.Copy(w, in)
+	if err == nil && compress {
+		err = w.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = data.DeleteFile(tmp)
+		return errors.Wrap(err, fmt.Sprintf("copying file %s to %s", from, tmp))
+	}
+	if err := os.Rename(tmp, to); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("renaming file %s", tmp))
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package queue
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/devisions/go-playground/go-directio/config"
+	"github.com/pkg/errors"
+)
+
+// Modes of saving the commits of a consumer (see `Reader.Commit`) to its state file.
+const (
+	// Save the state on each commit, before `Reader.Commit` returns.
+	COMMIT_ALWAYS = "always"
+	// Save the state in the background, after every N commits.
+	COMMIT_RECORDS = "records"
+	// Save the state in the background, every interval (if anything got committed meanwhile).
+	COMMIT_INTERVAL = "interval"
+	// Save the state only on `Reader.FlushCommits` (and on `Reader.Close`).
+	COMMIT_EXPLICIT = "explicit"
+)
+
+// CommitPolicy tells when the commits of a consumer get saved to its state file.
+// Regardless of the mode, the last commit gets saved when the Reader is closed.
+type CommitPolicy struct {
+	Mode         string
+	EveryRecords int
+	Interval     time.Duration
+}
+
+func newCommitPolicy(cfg *config.Config) (CommitPolicy, error) {
+	p := CommitPolicy{
+		Mode:         cfg.ConsumerCommitMode,
+		EveryRecords: cfg.ConsumerCommitEveryRecords,
+		Interval:     cfg.ConsumerCommitInterval,
+	}
+	switch {
+	case p.Mode == COMMIT_RECORDS && p.EveryRecords <= 0:
+		return p, errors.New("the number of records between commits must be positive")
+	case p.Mode == COMMIT_INTERVAL && p.Interval <= 0:
+		return p, errors.New("the interval between commits must be positive")
+	case p.Mode != COMMIT_ALWAYS && p.Mode != COMMIT_RECORDS && p.Mode != COMMIT_INTERVAL && p.Mode != COMMIT_EXPLICIT:
+		return p, errors.New(fmt.Sprintf("unknown commit mode '%s'", p.Mode))
+	}
+	return p, nil
+}
+
+// committer saves the commits of a consumer to its state file, according to the commit policy.
+// In COMMIT_RECORDS and COMMIT_INTERVAL modes, the saves happen in a background goroutine,
+// so that the consumer does not wait for them.
+type committer struct {
+	policy CommitPolicy
+
+	// Guards the fields below.
+	mu sync.Mutex
+	// The state, as last saved.
+	state *ConsumerState
+	// The last committed offset (the one that follows the consumed data).
+	next uint64
+	// Number of commits not saved yet.
+	pending int
+	// The error of a failed background save, not reported yet.
+	err error
+
+	// Serializes the saves.
+	saveMu sync.Mutex
+
+	// Used for telling the background goroutine that a save is due, that it must stop and that it stopped.
+	due  chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newCommitter(policy CommitPolicy, state *ConsumerState) *committer {
+	c := committer{
+		policy: policy,
+		state:  state,
+		next:   state.NextOffset,
+	}
+	if policy.Mode == COMMIT_RECORDS || policy.Mode == COMMIT_INTERVAL {
+		c.due = make(chan struct{}, 1)
+		c.stop = make(chan struct{})
+		c.done = make(chan struct{})
+		go c.run()
+	}
+	return &c
+}
+
+// commit records `next` as the committed offset, saving it if due. It returns the error of a previous
+// background save that failed, if any.
+func (c *committer) commit(next uint64) error {
+	c.mu.Lock()
+	c.next = next
+	c.pending++
+	pending, err := c.pending, c.err
+	c.err = nil
+	c.mu.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "saving the state in the background")
+	}
+	switch c.policy.Mode {
+	case COMMIT_ALWAYS:
+		return c.save()
+	case COMMIT_RECORDS:
+		if pending >= c.policy.EveryRecords {
+			select {
+			case c.due <- struct{}{}:
+			default: // A save is already due.
+			}
+		}
+	}
+	return nil
+}
+
+// run saves the commits in the background, whenever a save is due, until told to stop.
+func (c *committer) run() {
+	defer close(c.done)
+	var tick <-chan time.Time
+	if c.policy.Mode == COMMIT_INTERVAL {
+		ticker := time.NewTicker(c.policy.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-c.due:
+		case <-tick:
+		}
+		if err := c.save(); err != nil {
+			log.Printf("[WARN] Failed to save the state in the background. Reason: %s\n", err)
+			c.mu.Lock()
+			c.err = err
+			c.mu.Unlock()
+		}
+	}
+}
+
+// save saves the last committed offset, if not already saved.
+func (c *committer) save() error {
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+	c.mu.Lock()
+	next, pending := c.next, c.pending
+	c.pending = 0
+	c.mu.Unlock()
+	if pending == 0 {
+		return nil
+	}
+	// A copy gets saved, so that the state (see `Reader.State`) changes only once saved.
+	c.mu.Lock()
+	s := *c.state
+	c.mu.Unlock()
+	s.NextOffset = next
+	if err := s.SaveToFile(); err != nil {
+		c.mu.Lock()
+		c.pending += pending // To be saved again.
+		c.mu.Unlock()
+		return err
+	}
+	c.mu.Lock()
+	*c.state = s
+	c.mu.Unlock()
+	return nil
+}
+
+// saved returns a copy of the state, as last saved.
+func (c *committer) saved() *ConsumerState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := *c.state
+	return &s
+}
+
+// close stops the background goroutine (if any) and saves the last committed offset.
+func (c *committer) close() error {
+	if c.stop != nil {
+		close(c.stop)
+		<-c.done
+		c.stop = nil
+	}
+	return c.save()
+}
@@ -0,0 +1,180 @@
+package queue
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReadData is a record read by a Reader.
+type ReadData struct {
+	// The key, the timestamp and the headers of the record.
+	Metadata
+	// The payload, as it was appended.
+	Payload []byte
+	// The id of the codec used for encoding the payload (`codec.RawID` if it was appended as it is).
+	CodecID byte
+	// The offset of the record in the whole log.
+	Offset uint64
+	// The id of the idempotent producer that appended the record (0 if none) and the record's sequence number.
+	ProducerID uint32
+	Sequence   uint64
+	// The file that contains the record.
+	FromFilepath string
+}
+
+// getFilepathForReading returns the file (aka segment), from any of the dirs, that contains the record
+// having `offset`, that is the one with the greatest base offset not exceeding `offset`.
+// If all the files start after `offset`, the first one is returned.
+func getFilepathForReading(dirs []string, offset uint64) (string, error) {
+	fps, err := getSegmentFilepaths(dirs)
+	if err != nil {
+		return "", err
+	}
+	if len(fps) == 0 {
+		return "", os.ErrNotExist
+	}
+	found := fps[0]
+	for _, fp := range fps[1:] {
+		base, _ := getBaseOffsetOfFilename(fp)
+		if base > offset {
+			break
+		}
+		found = fp
+	}
+	return found, nil
+}
+
+// getFilepathForReadingSince returns the last file (aka segment), from any of the dirs, created not after `t`.
+// Its records and the ones of the next files are the only ones that might have been appended at or after `t`.
+// If all the files were created after `t`, the first one is returned.
+func getFilepathForReadingSince(dirs []string, t time.Time, blocksize int) (string, error) {
+	fps, err := getSegmentFilepaths(dirs)
+	if err != nil {
+		return "", err
+	}
+	if len(fps) == 0 {
+		return "", os.ErrNotExist
+	}
+	var ferr error
+	// The files are created one after the other, so their creation times are sorted as well.
+	i := sort.Search(len(fps), func(i int) bool {
+		createdAt, err := getCreationTimeOfFile(fps[i], blocksize)
+		if err != nil && ferr == nil {
+			ferr = err
+		}
+		return err != nil || createdAt.After(t)
+	})
+	if ferr != nil {
+		return "", ferr
+	}
+	if i > 0 {
+		i--
+	}
+	return fps[i], nil
+}
+
+// getCreationTimeOfFile returns the creation time stored in the header of the file (aka segment).
+// A file whose header is not written yet is considered just created.
+func getCreationTimeOfFile(filepath string, blocksize int) (time.Time, error) {
+	f, _, h, err := openSegmentForReading(filepath, blocksize)
+	if err == io.EOF {
+		return time.Now(), nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	_ = f.Close()
+	return h.CreatedAt, nil
+}
+
+// getNextFilepathForReading returns the file (aka segment), from any of the dirs, that follows the last read one.
+func getNextFilepathForReading(dirs []string, lastFilepath string) (string, error) {
+	fps, err := getSegmentFilepaths(dirs)
+	if err != nil {
+		return "", err
+	}
+	lastBase, err := getBaseOffsetOfFilename(lastFilepath)
+	if err != nil {
+		return "", err
+	}
+	for _, fp := range fps {
+		base, _ := getBaseOffsetOfFilename(fp)
+		if base > lastBase {
+			return fp, nil
+		}
+	}
+	return "", os.ErrNotExist
+}
+
+// getSegmentFilepaths returns the files (aka segments) of the dirs, sorted by their base offset.
+// A file found in more dirs (ex: while being archived) is returned once, from the first of them.
+// Missing dirs are ignored.
+func getSegmentFilepaths(dirs []string) ([]string, error) {
+	byBase := make(map[uint64]string)
+	bases := make([]uint64, 0)
+	for _, dir := range dirs {
+		fnames, err := getSegmentFileNames(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, fn := range fnames {
+			base, _ := getBaseOffsetOfFilename(fn)
+			if _, found := byBase[base]; !found {
+				byBase[base] = dir + string(os.PathSeparator) + fn
+				bases = append(bases, base)
+			}
+		}
+	}
+	sort.Slice(bases, func(i, j int) bool { return bases[i] < bases[j] })
+	fps := make([]string, len(bases))
+	for i, base := range bases {
+		fps[i] = byBase[base]
+	}
+	return fps, nil
+}
+
+// getSegmentFileNames returns the names of the files (aka segments) of the path, sorted by their base offset.
+// Besides the `.dat` files, it includes the compressed ones (`.dat.gz`) that exist in an archive path.
+func getSegmentFileNames(iopath string) ([]string, error) {
+	f, err := os.Open(iopath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	all, err := f.Readdirnames(0)
+	if err != nil {
+		return nil, err
+	}
+	fnames := make([]string, 0, len(all))
+	for _, fn := range all {
+		if ".dat" != path.Ext(strings.TrimSuffix(fn, COMPRESSED_EXT)) {
+			continue
+		}
+		if _, err := getBaseOffsetOfFilename(fn); err != nil {
+			// ignoring it, it doesn't follow the pattern {base offset}.dat (ex: 00000000000000001024.dat)
+			continue
+		}
+		fnames = append(fnames, fn)
+	}
+	// Being zero padded, sorting the names sorts the base offsets.
+	sort.Strings(fnames)
+	return fnames, nil
+}
+
+// getBaseOffsetOfFilename returns the base offset that the file (aka segment) is named after.
+func getBaseOffsetOfFilename(filepath string) (uint64, error) {
+	return strconv.ParseUint(path.Base(segmentFilepathWithoutExt(filepath)), 10, 64)
+}
+
+// segmentFilepathWithoutExt returns the path of the file (aka segment), without its extension(s).
+func segmentFilepathWithoutExt(filepath string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(filepath, COMPRESSED_EXT), ".dat")
+}
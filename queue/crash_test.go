@@ -0,0 +1,353 @@
+package queue
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/devisions/go-playground/go-directio/codec"
+	"github.com/devisions/go-playground/go-directio/config"
+	"github.com/pkg/errors"
+)
+
+// The environment variable that makes the test binary run as the writer that `TestWriterKilled` kills,
+// appending into the path it holds.
+const killedWriterPathEnv = "QUEUE_TEST_KILLED_WRITER_PATH"
+
+// How many records the killed writer flushes, at least, before being killed.
+const flushedBeforeKill = 500
+
+func newTestConfig(path string) *config.Config {
+	return &config.Config{
+		BlockSize:          4096,
+		MaxFileSizeBytes:   16 * 1024, // So that the records span several files.
+		Path:               path,
+		SyncMode:           SYNC_NONE,
+		DirectIOPolicy:     DIRECT_IO_FALLBACK, // The temporary directory might be on a tmpfs.
+		WriteBufferBytes:   8192,
+		ReadBufferBytes:    16384, // Several blocks at once, so that the ones read ahead get dropped on a rewind.
+		ConsumerName:       "test",
+		ConsumerCommitMode: COMMIT_EXPLICIT,
+	}
+}
+
+// testValue returns the value of the record having `offset`, that is `size` bytes long (at least).
+func testValue(offset uint64, size int) string {
+	v := strconv.FormatUint(offset, 10) + ":"
+	if len(v) < size {
+		v += strings.Repeat("x", size-len(v))
+	}
+	return v
+}
+
+// testOffset returns the offset that the value was written for.
+func testOffset(v string) (uint64, error) {
+	return strconv.ParseUint(v[:strings.IndexByte(v, ':')], 10, 64)
+}
+
+// appendTestValues appends the values of the offsets from the Writer's next one up to `until` (excluded) and flushes them.
+func appendTestValues(q *Queue[string], w *Writer, until uint64, size int) error {
+	for o := w.NextOffset(); o < until; o++ {
+		if err := q.Write(testValue(o, size)); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// The error of the handler failing on purpose.
+var errHandlerFailing = errors.New("failing on purpose")
+
+// consumer consumes the values of a path, checking that they are delivered at least once and in order.
+type consumer struct {
+	cfg *config.Config
+	r   *Reader
+	q   *Queue[string]
+	// The offset of the next value that was never delivered.
+	next uint64
+	// The offsets of the records skipped as they cannot be decoded.
+	undecodable []uint64
+	// Deliveries so far, used for failing the handler and dropping the Reader every now and then.
+	deliveries int
+	// The Readers dropped without being closed (ex: as if the process died), closed at the end.
+	dropped []*Reader
+}
+
+func newConsumer(cfg *config.Config) (*consumer, error) {
+	c := consumer{cfg: cfg}
+	if err := c.reopen(); err != nil {
+		return nil, err
+	}
+	// The values before the saved state got delivered to a previous consumer.
+	c.next = c.r.NextOffset()
+	return &c, nil
+}
+
+// reopen drops the current Reader (if any), without saving its commits, and opens a new one, from the saved state.
+func (c *consumer) reopen() error {
+	if c.r != nil {
+		c.dropped = append(c.dropped, c.r)
+	}
+	r, err := NewReader(c.cfg)
+	if err != nil {
+		return err
+	}
+	q, err := NewQueue[string](nil, r, codec.JSON[string]{})
+	if err != nil {
+		_ = r.Close()
+		return err
+	}
+	c.r, c.q = r, q
+	return nil
+}
+
+// consumeAll consumes the values until there is nothing else to read, failing the handler of every 7th delivery
+// and dropping the Reader after every 50th delivery. The commits get saved every 10 deliveries.
+// The records that cannot be decoded count as delivered.
+func (c *consumer) consumeAll() error {
+	for {
+		err := c.q.Consume(func(item *Item[string]) error {
+			c.deliveries++
+			o, err := testOffset(item.Value)
+			if err != nil {
+				return err
+			}
+			if o != item.Offset || o > c.next {
+				return errors.New(fmt.Sprintf("got the value of offset %d from offset %d, while the next one never delivered is %d", o, item.Offset, c.next))
+			}
+			if c.deliveries%7 == 0 {
+				return errHandlerFailing
+			}
+			if o == c.next {
+				c.next++
+			}
+			return nil
+		})
+		if err == io.EOF || err == os.ErrNotExist {
+			return c.r.FlushCommits()
+		}
+		switch e := err.(type) {
+		case nil:
+		case *HandlerError:
+			if e.Err != errHandlerFailing {
+				return e
+			}
+		case *DecodeError:
+			c.deliveries++
+			if e.Record.Offset > c.next {
+				return errors.New(fmt.Sprintf("got offset %d, while the next one never delivered is %d", e.Record.Offset, c.next))
+			}
+			if e.Record.Offset == c.next {
+				c.undecodable = append(c.undecodable, c.next)
+				c.next++
+			}
+		default:
+			return err
+		}
+		if c.deliveries%10 == 0 {
+			if err := c.r.FlushCommits(); err != nil {
+				return err
+			}
+		}
+		if c.deliveries%50 == 0 {
+			if err := c.reopen(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *consumer) close() {
+	for _, r := range append(c.dropped, c.r) {
+		_ = r.Close()
+	}
+}
+
+// TestWriterKilled kills a process while it appends and then checks that a new Writer continues after the records
+// left in the files, while a consumer, dropped (without saving its commits) and failing every now and then,
+// gets all the records delivered in order: the ones flushed before the kill, at least, and the ones appended after.
+func TestWriterKilled(t *testing.T) {
+	if path := os.Getenv(killedWriterPathEnv); path != "" {
+		runKilledWriter(path)
+		return
+	}
+	cfg := newTestConfig(t.TempDir())
+	cmd := exec.Command(os.Args[0], "-test.run=^TestWriterKilled$")
+	cmd.Env = append(os.Environ(), killedWriterPathEnv+"="+cfg.Path)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// The writer prints how many records it flushed so far.
+	flushed := 0
+	for sc := bufio.NewScanner(out); flushed < flushedBeforeKill && sc.Scan(); {
+		if n, err := strconv.Atoi(sc.Text()); err == nil {
+			flushed = n
+		}
+	}
+	if err := cmd.Process.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	_ = cmd.Wait()
+	if flushed < flushedBeforeKill {
+		t.Fatalf("the writer ended after flushing %d records", flushed)
+	}
+
+	c, err := newConsumer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	if err := c.consumeAll(); err != nil {
+		t.Fatal(err)
+	}
+	if c.next < uint64(flushed) {
+		t.Fatalf("got %d records, while %d got flushed before the kill", c.next, flushed)
+	}
+
+	w, err := NewWriter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = w.Close() }()
+	if w.NextOffset() != c.next {
+		t.Fatalf("the new Writer continues from offset %d, while %d records were read", w.NextOffset(), c.next)
+	}
+	q, err := NewQueue[string](w, nil, codec.JSON[string]{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := w.NextOffset() + 200
+	if err := appendTestValues(q, w, last, 300); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.consumeAll(); err != nil {
+		t.Fatal(err)
+	}
+	if c.next != last {
+		t.Fatalf("got %d records, instead of %d", c.next, last)
+	}
+}
+
+// runKilledWriter appends records into the path, printing how many it flushed after every few of them, until killed.
+func runKilledWriter(path string) {
+	cfg := newTestConfig(path)
+	w, err := NewWriter(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "creating the writer:", err)
+		os.Exit(1)
+	}
+	q, _ := NewQueue[string](w, nil, codec.JSON[string]{})
+	for {
+		// Some records span several blocks, so the kill might happen between their writes.
+		size := 100
+		if w.NextOffset()%11 == 0 {
+			size = 10_000
+		}
+		if err := appendTestValues(q, w, w.NextOffset()+7, size); err != nil {
+			fmt.Fprintln(os.Stderr, "appending:", err)
+			os.Exit(1)
+		}
+		fmt.Println(w.NextOffset())
+	}
+}
+
+// TestTornTail aborts a Writer in the middle of writing a record that spans several blocks and then checks
+// that a new Writer discards the torn record, appending after the last complete one, and that a Reader
+// that already got to the torn record reads the new records, as a new Reader does.
+// A record that cannot be decoded gets skipped (see `Queue.Consume`).
+func TestTornTail(t *testing.T) {
+	cfg := newTestConfig(t.TempDir())
+	cfg.MaxFileSizeBytes = 1024 * 1024
+	w, err := NewWriter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := NewQueue[string](w, nil, codec.JSON[string]{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := appendTestValues(q, w, 100, 100); err != nil {
+		t.Fatal(err)
+	}
+	// The write buffer gets full in the middle of the record, so only its first blocks get written.
+	if err := q.Write(testValue(100, 3*cfg.WriteBufferBytes)); err != nil {
+		t.Fatal(err)
+	}
+	if w.full*w.blocksize+w.used == 0 {
+		t.Fatal("the record got written completely")
+	}
+	// Aborting: the files get closed, while the rest of the record stays in memory.
+	w.closeIndexes()
+	_ = w.engine.Close()
+	_ = w.out.Close()
+
+	c, err := newConsumer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	if err := c.consumeAll(); err != nil {
+		t.Fatal(err)
+	}
+	if c.next != 100 {
+		t.Fatalf("got %d records before the torn one, instead of 100", c.next)
+	}
+
+	w, err = NewWriter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = w.Close() }()
+	if w.NextOffset() != 100 {
+		t.Fatalf("the new Writer continues from offset %d, instead of 100", w.NextOffset())
+	}
+	q, err = NewQueue[string](w, nil, codec.JSON[string]{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := appendTestValues(q, w, 150, 3*cfg.WriteBufferBytes); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.consumeAll(); err != nil {
+		t.Fatal(err)
+	}
+	if c.next != 150 {
+		t.Fatalf("got %d records, instead of 150", c.next)
+	}
+
+	// A raw payload has no codec in the Queue, so it cannot be decoded.
+	if err := w.Append([]byte("raw")); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendTestValues(q, w, 152, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.consumeAll(); err != nil {
+		t.Fatal(err)
+	}
+	if c.next != 152 || len(c.undecodable) != 1 || c.undecodable[0] != 150 {
+		t.Fatalf("got %d records, skipping %v, instead of 152, skipping 150", c.next, c.undecodable)
+	}
+
+	fresh := newTestConfig(cfg.Path)
+	fresh.ConsumerName = "fresh"
+	if c, err = newConsumer(fresh); err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	if err := c.consumeAll(); err != nil {
+		t.Fatal(err)
+	}
+	if c.next != 152 || len(c.undecodable) != 1 {
+		t.Fatalf("a new Reader got %d records, skipping %v, instead of 152, skipping 150", c.next, c.undecodable)
+	}
+}
@@ -0,0 +1,128 @@
+package queue
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/devisions/go-playground/go-directio/ioengine"
+	"github.com/ncw/directio"
+	"github.com/pkg/errors"
+)
+
+// The id 0 is used by the records of the producers that are not idempotent.
+var errReservedProducerID = errors.New("the producer id 0 is reserved for the records of non idempotent producers")
+
+// DuplicateError is returned when an idempotent producer appends a record having a sequence number
+// that is not greater than the one of its last record, that was already appended.
+type DuplicateError struct {
+	ProducerID   uint32
+	Sequence     uint64
+	LastSequence uint64
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("duplicate record of producer %d: sequence %d, while the last one is %d", e.ProducerID, e.Sequence, e.LastSequence)
+}
+
+// producerSequence is the sequence number of a record of an idempotent producer, that is not written yet.
+type producerSequence struct {
+	producerID uint32
+	sequence   uint64
+	// The position in the file right after the record.
+	end int64
+}
+
+// lastSequence returns the sequence number of the last record appended by the idempotent producer, written or not.
+func (w *Writer) lastSequence(producerID uint32) (uint64, bool) {
+	if seq, found := w.pending[producerID]; found {
+		return seq, true
+	}
+	seq, found := w.producers[producerID]
+	return seq, found
+}
+
+// sequencesWritten applies the sequence numbers of the records that got written to the ones of the producers.
+// While a transaction is open, the ones appended before it began are also applied to the ones restored on abort.
+func (w *Writer) sequencesWritten() {
+	n := 0
+	for ; n < len(w.unwritten) && w.unwritten[n].end <= w.written; n++ {
+		ps := w.unwritten[n]
+		w.producers[ps.producerID] = ps.sequence
+		if w.pending[ps.producerID] == ps.sequence {
+			delete(w.pending, ps.producerID)
+		}
+		if w.inTxn && n < w.txnUnwritten {
+			w.txnProducers[ps.producerID] = ps.sequence
+		}
+	}
+	if w.inTxn {
+		w.txnUnwritten -= n
+		if w.txnUnwritten < 0 {
+			w.txnUnwritten = 0
+		}
+	}
+	w.unwritten = w.unwritten[:copy(w.unwritten, w.unwritten[n:])]
+}
+
+// loadProducerSequences rebuilds the sequence number of the last record of each idempotent producer,
+// by scanning the latest `segments` files of the path (all of them, if `segments` is 0).
+// The producers that did not append to these files are not known, so their duplicates cannot be detected.
+// The records of the aborted transactions (and of the one left open, that is going to be aborted) do not count.
+func loadProducerSequences(path string, blocksize int, segments int) (map[uint32]uint64, error) {
+	fnames, err := getSegmentFileNames(path)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("looking for files on path '%s'", path))
+	}
+	if segments > 0 && len(fnames) > segments {
+		fnames = fnames[len(fnames)-segments:]
+	}
+	producers := make(map[uint32]uint64)
+	txn := make(map[uint32]uint64)
+	blocks := [][]byte{directio.AlignedBlock(blocksize)}
+	for _, fn := range fnames {
+		if err := scanProducerSequences(path+string(os.PathSeparator)+fn, blocks, producers, txn); err != nil {
+			return nil, err
+		}
+	}
+	return producers, nil
+}
+
+// scanProducerSequences updates `producers` with the sequence numbers of the records of the file, up to its end of segment
+// record, if sealed. The ones of the records of a transaction are kept in `txn`, until it gets committed or aborted.
+func scanProducerSequences(filepath string, blocks [][]byte, producers map[uint32]uint64, txn map[uint32]uint64) error {
+	sr, err := openSegmentReader(filepath, blocks, ioengine.Sync{})
+	if err == io.EOF {
+		return nil // Its header is not written yet.
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = sr.close() }()
+	for {
+		rec, err := sr.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case rec.kind == recordKindEnd:
+			return nil // Nothing written after it counts (ex: the blocks of a recycled file, left from its previous use).
+		case rec.kind == recordKindCommit:
+			for id, seq := range txn {
+				producers[id] = seq
+			}
+			fallthrough
+		case rec.kind == recordKindBegin || rec.kind == recordKindAbort:
+			for id := range txn {
+				delete(txn, id)
+			}
+		case rec.kind == recordKindData && rec.producerID != 0 && rec.flags&recordFlagTransactional != 0:
+			txn[rec.producerID] = rec.sequence
+		case rec.kind == recordKindData && rec.producerID != 0:
+			producers[rec.producerID] = rec.sequence
+		}
+	}
+}
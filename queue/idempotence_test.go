@@ -0,0 +1,57 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/devisions/go-playground/go-directio/codec"
+)
+
+// TestProducerSequencesAfterRestart appends the records of two idempotent producers into recycled files, that get sealed
+// before being full (so their blocks after the end of segment record are the ones of their previous use), and then checks
+// that a new Writer rebuilds the sequence numbers of the producers, rejecting the duplicates of the records appended before.
+func TestProducerSequencesAfterRestart(t *testing.T) {
+	cfg := newRecycleTestConfig(t.TempDir())
+	w, err := NewWriter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := NewQueue[string](w, nil, codec.JSON[string]{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := appendSizedValues(q, w, 20, []int{25_000, 5_000}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := recycleConsumed(cfg); err != nil || n == 0 {
+		t.Fatalf("got %d recycled files (err: %v)", n, err)
+	}
+	// Two records of 12000 bytes fill 6 blocks of a file, so it gets sealed with a block left.
+	for o := w.NextOffset(); o < 40; o++ {
+		if err := q.WriteIdempotent(uint32(1+o%2), o, testValue(o, 12_000), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if w, err = NewWriter(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = w.Close() }()
+	if q, err = NewQueue[string](w, nil, codec.JSON[string]{}); err != nil {
+		t.Fatal(err)
+	}
+	for id, last := range map[uint32]uint64{1: 38, 2: 39} {
+		if seq, found := w.ProducerSequence(id); !found || seq != last {
+			t.Fatalf("producer %d got sequence %d (found: %v), instead of %d", id, seq, found, last)
+		}
+		err := q.WriteIdempotent(id, last, testValue(w.NextOffset(), 100), nil)
+		if _, ok := err.(*DuplicateError); !ok {
+			t.Fatalf("producer %d appended sequence %d again, getting: %v", id, last, err)
+		}
+		if err := q.WriteIdempotent(id, last+2, testValue(w.NextOffset(), 100), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
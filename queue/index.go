@@ -0,0 +1,322 @@
+package queue
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/devisions/go-playground/go-directio/internal/data"
+	"github.com/pkg/errors"
+)
+
+// Every INDEX_INTERVAL-th record of a segment, starting with its first one, gets an entry in the segment's indexes.
+const INDEX_INTERVAL = 64
+
+// Size of an (offset) index entry:
+// - the offset of the record (8 bytes)
+// - the position of the block that contains the record's header (8 bytes)
+// - the position of the record's header in that block (4 bytes)
+// - the checksum of all the above (4 bytes)
+const indexEntrySize = 24
+
+// Size of a time index entry: the timestamp (8 bytes) followed by an (offset) index entry.
+const timeIndexEntrySize = 8 + indexEntrySize
+
+// indexEntry maps the offset of a record to its position in the segment.
+type indexEntry struct {
+	offset uint64
+	// The (block aligned) position of the block that contains the record's header.
+	block int64
+	// The position of the record's header in that block.
+	inBlock int
+}
+
+func newIndexEntry(offset uint64, pos int64, blocksize int) indexEntry {
+	inBlock := int(pos % int64(blocksize))
+	return indexEntry{offset: offset, block: pos - int64(inBlock), inBlock: inBlock}
+}
+
+// position returns the position of the record's header in the segment.
+func (e indexEntry) position() int64 {
+	return e.block + int64(e.inBlock)
+}
+
+func (e indexEntry) encodeTo(to []byte) {
+	copy(to[0:8], data.I64toBytes(e.offset))
+	copy(to[8:16], data.I64toBytes(uint64(e.block)))
+	copy(to[16:20], data.I32toBytes(uint32(e.inBlock)))
+	copy(to[20:24], data.I32toBytes(crc32cOf(to[:20])))
+}
+
+func decodeIndexEntry(from []byte) (indexEntry, error) {
+	if data.BytesToI32(from[20:24]) != crc32cOf(from[:20]) {
+		return indexEntry{}, errors.New("checksum mismatch")
+	}
+	return indexEntry{
+		offset:  data.BytesToI64(from[0:8]),
+		block:   int64(data.BytesToI64(from[8:16])),
+		inBlock: int(data.BytesToI32(from[16:20])),
+	}, nil
+}
+
+// validate checks that the entry can belong to the index of the segment having `baseOffset`, following the `prev` entry (if any).
+func (e indexEntry) validate(prev *indexEntry, baseOffset uint64, blocksize int) error {
+	if e.offset < baseOffset || !isIndexed(e.offset, baseOffset) ||
+		e.block < int64(blocksize) || e.block%int64(blocksize) != 0 || e.inBlock > blocksize-recordHeaderSize {
+		return errors.New("invalid entry")
+	}
+	if prev != nil && (e.offset <= prev.offset || e.position() <= prev.position()) {
+		return errors.New("entry out of order")
+	}
+	return nil
+}
+
+// timeIndexEntry maps a timestamp to the position of a record in the segment:
+// all the records of the segment before that record have a timestamp not greater than it.
+type timeIndexEntry struct {
+	// The greatest timestamp (as Unix nanoseconds) of the segment's records before the entry's record.
+	timestamp int64
+	indexEntry
+}
+
+func (e timeIndexEntry) encodeTo(to []byte) {
+	copy(to[0:8], data.I64toBytes(uint64(e.timestamp)))
+	e.indexEntry.encodeTo(to[8:])
+}
+
+func decodeTimeIndexEntry(from []byte) (timeIndexEntry, error) {
+	e, err := decodeIndexEntry(from[8:])
+	if err != nil {
+		return timeIndexEntry{}, err
+	}
+	return timeIndexEntry{timestamp: int64(data.BytesToI64(from[0:8])), indexEntry: e}, nil
+}
+
+// isIndexed tells if the record having `offset` gets an entry in the indexes of the segment having `baseOffset`.
+func isIndexed(offset uint64, baseOffset uint64) bool {
+	return (offset-baseOffset)%INDEX_INTERVAL == 0
+}
+
+// indexBuilder builds the entries of a segment's indexes, as its records get appended (or scanned).
+type indexBuilder struct {
+	baseOffset uint64
+	blocksize  int
+	// The greatest timestamp of the records so far.
+	maxTimestamp int64
+	entries      []indexEntry
+	timeEntries  []timeIndexEntry
+}
+
+// add adds the data record having `offset` and `timestamp`, whose header is at position `pos` of the segment.
+func (b *indexBuilder) add(offset uint64, pos int64, timestamp int64) {
+	if isIndexed(offset, b.baseOffset) {
+		e := newIndexEntry(offset, pos, b.blocksize)
+		b.entries = append(b.entries, e)
+		b.timeEntries = append(b.timeEntries, timeIndexEntry{timestamp: b.maxTimestamp, indexEntry: e})
+	}
+	if timestamp > b.maxTimestamp {
+		b.maxTimestamp = timestamp
+	}
+}
+
+// reset forgets the entries built so far, while keeping the greatest timestamp.
+func (b *indexBuilder) reset() {
+	b.drop(len(b.entries))
+}
+
+// drop forgets the first `n` entries built so far (ex: once written), while keeping the greatest timestamp.
+func (b *indexBuilder) drop(n int) {
+	b.entries = append(b.entries[:0], b.entries[n:]...)
+	b.timeEntries = append(b.timeEntries[:0], b.timeEntries[n:]...)
+}
+
+func encodeIndex(entries []indexEntry) []byte {
+	b := make([]byte, len(entries)*indexEntrySize)
+	for i, e := range entries {
+		e.encodeTo(b[i*indexEntrySize:])
+	}
+	return b
+}
+
+func encodeTimeIndex(entries []timeIndexEntry) []byte {
+	b := make([]byte, len(entries)*timeIndexEntrySize)
+	for i, e := range entries {
+		e.encodeTo(b[i*timeIndexEntrySize:])
+	}
+	return b
+}
+
+// indexFilepath returns the path of the (offset) index of the segment.
+func indexFilepath(segmentFilepath string) string {
+	return segmentFilepathWithoutExt(segmentFilepath) + ".idx"
+}
+
+// timeIndexFilepath returns the path of the time index of the segment.
+func timeIndexFilepath(segmentFilepath string) string {
+	return segmentFilepathWithoutExt(segmentFilepath) + ".tix"
+}
+
+// readIndexFile reads the index of the segment having `baseOffset`, validating its entries.
+// A trailing incomplete entry (not completely written yet) is ignored.
+func readIndexFile(filepath string, baseOffset uint64, blocksize int) ([]indexEntry, error) {
+	b, err := os.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]indexEntry, 0, len(b)/indexEntrySize)
+	for i := 0; i+indexEntrySize <= len(b); i += indexEntrySize {
+		e, err := decodeIndexEntry(b[i : i+indexEntrySize])
+		if err == nil && len(entries) > 0 {
+			err = e.validate(&entries[len(entries)-1], baseOffset, blocksize)
+		} else if err == nil {
+			err = e.validate(nil, baseOffset, blocksize)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("entry %d", len(entries)))
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// readTimeIndexFile reads the time index of the segment having `baseOffset`, validating its entries.
+// A trailing incomplete entry (not completely written yet) is ignored.
+func readTimeIndexFile(filepath string, baseOffset uint64, blocksize int) ([]timeIndexEntry, error) {
+	b, err := os.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]timeIndexEntry, 0, len(b)/timeIndexEntrySize)
+	for i := 0; i+timeIndexEntrySize <= len(b); i += timeIndexEntrySize {
+		e, err := decodeTimeIndexEntry(b[i : i+timeIndexEntrySize])
+		if err == nil && len(entries) > 0 {
+			prev := entries[len(entries)-1]
+			err = e.validate(&prev.indexEntry, baseOffset, blocksize)
+			if err == nil && e.timestamp < prev.timestamp {
+				err = errors.New("entry out of order")
+			}
+		} else if err == nil {
+			err = e.validate(nil, baseOffset, blocksize)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("entry %d", len(entries)))
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// writeIndexFile (re)writes a whole (encoded) index, replacing the existing one (if any).
+func writeIndexFile(filepath string, b []byte) error {
+	tmp := filepath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0665); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("writing the index to file %s", tmp))
+	}
+	if err := os.Rename(tmp, filepath); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("replacing the index file %s", filepath))
+	}
+	return nil
+}
+
+// writeIndexFiles (re)writes both indexes of the segment, using the entries built so far.
+func writeIndexFiles(segmentFilepath string, b *indexBuilder) error {
+	if err := writeIndexFile(indexFilepath(segmentFilepath), encodeIndex(b.entries)); err != nil {
+		return err
+	}
+	return writeIndexFile(timeIndexFilepath(segmentFilepath), encodeTimeIndex(b.timeEntries))
+}
+
+// openIndexForWriting opens an index for appending entries to it.
+func openIndexForWriting(filepath string) (*os.File, error) {
+	f, err := os.OpenFile(filepath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0665)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("while opening index file %s for writing", filepath))
+	}
+	return f, nil
+}
+
+// rebuildIndexes scans the segment for building its indexes.
+// They are saved only if the segment is sealed, since otherwise its Writer owns them.
+// The records of a segment being written are followed by anything (see `segmentReader.next`),
+// so a corrupted record only ends the scan.
+func rebuildIndexes(segmentFilepath string, blocksize int) (*indexBuilder, error) {
+	info, err := scanSegment(segmentFilepath, blocksize)
+	if _, ok := err.(*CorruptionError); ok {
+		err = nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "rebuilding the indexes")
+	}
+	if info.sealed {
+		if err := writeIndexFiles(segmentFilepath, info.index); err != nil {
+			log.Printf("[WARN] Failed to save the rebuilt indexes of file '%s'. Reason: %s\n", segmentFilepath, err)
+		}
+	}
+	return info.index, nil
+}
+
+// loadIndex returns the index of the segment, rebuilding it from the segment if it is missing or corrupted.
+func loadIndex(segmentFilepath string, baseOffset uint64, blocksize int) ([]indexEntry, error) {
+	entries, err := readIndexFile(indexFilepath(segmentFilepath), baseOffset, blocksize)
+	if err == nil {
+		return entries, nil
+	}
+	logRebuilding(segmentFilepath, "index", err)
+	b, err := rebuildIndexes(segmentFilepath, blocksize)
+	if err != nil {
+		return nil, err
+	}
+	return b.entries, nil
+}
+
+// loadTimeIndex returns the time index of the segment, rebuilding it from the segment if it is missing or corrupted.
+func loadTimeIndex(segmentFilepath string, baseOffset uint64, blocksize int) ([]timeIndexEntry, error) {
+	entries, err := readTimeIndexFile(timeIndexFilepath(segmentFilepath), baseOffset, blocksize)
+	if err == nil {
+		return entries, nil
+	}
+	logRebuilding(segmentFilepath, "time index", err)
+	b, err := rebuildIndexes(segmentFilepath, blocksize)
+	if err != nil {
+		return nil, err
+	}
+	return b.timeEntries, nil
+}
+
+func logRebuilding(segmentFilepath string, what string, reason error) {
+	if os.IsNotExist(reason) {
+		log.Printf("Rebuilding the missing %s of file %s\n", what, segmentFilepath)
+	} else {
+		log.Printf("[WARN] Rebuilding the %s of file '%s'. Reason: %s\n", what, segmentFilepath, reason)
+	}
+}
+
+// lookupIndex returns the last entry having an offset not greater than `offset`, if any.
+func lookupIndex(entries []indexEntry, offset uint64) (indexEntry, bool) {
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].offset > offset })
+	if i == 0 {
+		return indexEntry{}, false
+	}
+	return entries[i-1], true
+}
+
+// lookupTimeIndex returns the last entry having a timestamp lower than `timestamp`, if any.
+// The records before the entry's one are all older than `timestamp`.
+func lookupTimeIndex(entries []timeIndexEntry, timestamp int64) (timeIndexEntry, bool) {
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].timestamp >= timestamp })
+	if i == 0 {
+		return timeIndexEntry{}, false
+	}
+	return entries[i-1], true
+}
+
+// DeleteSegment deletes the file (aka segment) and its indexes.
+func DeleteSegment(segmentFilepath string) error {
+	for _, fp := range []string{indexFilepath(segmentFilepath), timeIndexFilepath(segmentFilepath)} {
+		if err := data.DeleteFile(fp); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return data.DeleteFile(segmentFilepath)
+}
@@ -0,0 +1,194 @@
+package queue
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devisions/go-playground/go-directio/codec"
+	"github.com/pkg/errors"
+)
+
+// readAt moves the Reader to `offset` (using `seek`) and reads the next value, that must be the one of `offset`.
+// It returns the position in the file that the Reader got to before reading.
+func readAt(q *Queue[string], r *Reader, offset uint64, seek func() error) (int64, error) {
+	if err := seek(); err != nil {
+		return 0, err
+	}
+	if r.in == nil {
+		return 0, errors.New(fmt.Sprintf("no file to read offset %d from", offset))
+	}
+	pos := r.in.position()
+	item, err := q.Read()
+	if err != nil {
+		return 0, err
+	}
+	if o, err := testOffset(item.Value); err != nil || item.Offset != offset || o != offset {
+		return 0, errors.New(fmt.Sprintf("got the value '%.20s' from offset %d, instead of offset %d", item.Value, item.Offset, offset))
+	}
+	return pos, nil
+}
+
+// TestSeekToOffset appends records into several files and then checks that a Reader moved to an offset reads the records
+// from that one on, skipping (using the index of the file that holds it) the blocks before the closest indexed record.
+// It then checks the same, once the indexes are missing or corrupted, as they get rebuilt from the files.
+func TestSeekToOffset(t *testing.T) {
+	cfg := newTestConfig(t.TempDir())
+	cfg.MaxFileSizeBytes = 64 * 1024 // So that the files have several indexed records.
+	w, err := NewWriter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := NewQueue[string](w, nil, codec.JSON[string]{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := appendTestValues(q, w, 1000, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fnames, err := getSegmentFileNames(cfg.Path)
+	if err != nil || len(fnames) < 3 {
+		t.Fatalf("got %d files (err: %v), instead of 3 at least", len(fnames), err)
+	}
+
+	r, err := NewReader(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Close() }()
+	if q, err = NewQueue[string](nil, r, codec.JSON[string]{}); err != nil {
+		t.Fatal(err)
+	}
+	check := func() {
+		for _, fn := range fnames {
+			base, _ := getBaseOffsetOfFilename(fn)
+			for _, o := range []uint64{base + 2*INDEX_INTERVAL + 5, base, base + 1} {
+				if o >= 1000 {
+					continue // The last file might have fewer records.
+				}
+				pos, err := readAt(q, r, o, func() error { return r.SeekToOffset(o) })
+				if err != nil {
+					t.Fatal(err)
+				}
+				if o >= base+INDEX_INTERVAL && pos <= int64(cfg.BlockSize) {
+					t.Fatalf("reading offset %d from the beginning of file %s", o, fn)
+				}
+			}
+		}
+	}
+	check()
+
+	// The index of the first file gets deleted and the one of the second file corrupted.
+	first := indexFilepath(cfg.Path + string(os.PathSeparator) + fnames[0])
+	second := indexFilepath(cfg.Path + string(os.PathSeparator) + fnames[1])
+	if err := os.Remove(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(second, []byte(strings.Repeat("x", 2*indexEntrySize)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	// Being sealed, their rebuilt indexes got saved.
+	for i, fp := range []string{first, second} {
+		base, _ := getBaseOffsetOfFilename(fnames[i])
+		if entries, err := readIndexFile(fp, base, cfg.BlockSize); err != nil || len(entries) < 3 {
+			t.Fatalf("the index %s has %d entries (err: %v)", fp, len(entries), err)
+		}
+	}
+
+	// There is nothing to read after the last record, until a new one gets appended.
+	if err := r.SeekToOffset(1000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Read(); err != io.EOF {
+		t.Fatalf("read after the last record, getting: %v", err)
+	}
+}
+
+// TestSeekToTime appends records into several files and then checks that a Reader moved to a time reads the records from
+// the first one having a timestamp at or after it, skipping (using the creation time of the files and the time index
+// of the chosen one) the files and the blocks having older records only.
+func TestSeekToTime(t *testing.T) {
+	cfg := newTestConfig(t.TempDir())
+	cfg.MaxFileSizeBytes = 64 * 1024 // So that the files have several indexed records.
+	w, err := NewWriter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := NewQueue[string](w, nil, codec.JSON[string]{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The Writer sets the timestamps, that get apart every now and then.
+	for w.NextOffset() < 1000 {
+		if err := appendTestValues(q, w, w.NextOffset()+100, 100); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReader(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Close() }()
+	if q, err = NewQueue[string](nil, r, codec.JSON[string]{}); err != nil {
+		t.Fatal(err)
+	}
+	var stamps []time.Time
+	for {
+		item, err := q.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		stamps = append(stamps, item.Timestamp)
+	}
+	if len(stamps) != 1000 {
+		t.Fatalf("read %d records, instead of 1000", len(stamps))
+	}
+
+	for _, o := range []uint64{0, 1, 150, 420, 777, 999} {
+		ts := stamps[o]
+		// The first record having a timestamp at or after it, as the timestamps might be equal.
+		first := o
+		for first > 0 && !stamps[first-1].Before(ts) {
+			first--
+		}
+		var base uint64
+		pos, err := readAt(q, r, first, func() error {
+			err := r.SeekToTime(ts)
+			if r.in != nil {
+				base = r.in.base
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first >= base+INDEX_INTERVAL && pos <= int64(cfg.BlockSize) {
+			t.Fatalf("reading offset %d from the beginning of the file having base offset %d", first, base)
+		}
+	}
+	if _, err := readAt(q, r, 0, func() error { return r.SeekToTime(stamps[0].Add(-time.Hour)) }); err != nil {
+		t.Fatal(err)
+	}
+	// There is nothing to read after the last record, until a newer one gets appended.
+	if err := r.SeekToTime(stamps[999].Add(time.Nanosecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Read(); err != io.EOF {
+		t.Fatalf("read after the last record, getting: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package queue
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/devisions/go-playground/go-directio/config"
+	"github.com/devisions/go-playground/go-directio/internal/data"
+	"github.com/devisions/go-playground/go-directio/ioengine"
+	"github.com/pkg/errors"
+)
+
+// Policies of using a path whose file system does not support direct I/O (O_DIRECT).
+const (
+	// Refuse to use the path, so creating a Writer or a Reader fails.
+	DIRECT_IO_REQUIRE = "require"
+	// Fall back to buffered I/O, syncing the written data (using fdatasync) and dropping it from the page cache
+	// every `dropPageCacheBytes` (and when a file is done with), to keep the page cache impact low.
+	DIRECT_IO_FALLBACK = "fallback"
+)
+
+// How many bytes the Writer writes using buffered I/O before syncing them and dropping them from the page cache.
+const dropPageCacheBytes = 1024 * 1024
+
+// selectIOMode probes the path for direct I/O support and returns the I/O mode that its files are used with,
+// according to the `policy`. Falling back to buffered I/O applies to all the files of the path (see `data.UseBufferedIO`).
+func selectIOMode(dir string, blocksize int, policy string) (string, error) {
+	if policy != DIRECT_IO_REQUIRE && policy != DIRECT_IO_FALLBACK {
+		return "", errors.New(fmt.Sprintf("unknown direct I/O policy '%s'", policy))
+	}
+	supported, err := data.ProbeDirectIO(dir, blocksize)
+	if err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("probing path '%s' for direct I/O support", dir))
+	}
+	if supported {
+		return data.IO_MODE_DIRECT, nil
+	}
+	if policy == DIRECT_IO_REQUIRE {
+		return "", errors.New(fmt.Sprintf("the file system of path '%s' does not support direct I/O (O_DIRECT), use %s=%s for falling back to buffered I/O",
+			dir, config.IO_DIRECT_POLICY, DIRECT_IO_FALLBACK))
+	}
+	log.Printf("[WARN] The file system of path '%s' does not support direct I/O (O_DIRECT), falling back to buffered I/O.\n", dir)
+	data.UseBufferedIO(dir)
+	return data.IO_MODE_BUFFERED, nil
+}
+
+// IOStats counts the writes (of a Writer) or the reads (of a Reader) of the blocks of the files, by the I/O mode
+// of the files: direct I/O or, if their path does not support it, buffered I/O (see `DIRECT_IO_FALLBACK`).
+// A Reader does not count the reads of the compressed (archived) files.
+type IOStats struct {
+	DirectOps     int64
+	DirectBytes   int64
+	BufferedOps   int64
+	BufferedBytes int64
+}
+
+// add counts a write (or read) of `n` bytes of the file.
+func (s *IOStats) add(filepath string, n int) {
+	if data.IOModeOf(filepath) == data.IO_MODE_BUFFERED {
+		s.BufferedOps++
+		s.BufferedBytes += int64(n)
+		return
+	}
+	s.DirectOps++
+	s.DirectBytes += int64(n)
+}
+
+func (s IOStats) String() string {
+	return fmt.Sprintf("direct: %d ops (%d bytes)  buffered: %d ops (%d bytes)", s.DirectOps, s.DirectBytes, s.BufferedOps, s.BufferedBytes)
+}
+
+// newEngine creates the I/O engine that the blocks of the files get read and written with.
+// If not configured, the sync engine is used and io_uring keeps up to `config.DEFAULT_ENGINE_QUEUE_DEPTH` reads or writes in flight.
+func newEngine(cfg *config.Config) (ioengine.Engine, error) {
+	name, depth := cfg.Engine, cfg.EngineQueueDepth
+	if name == "" {
+		name = ioengine.ENGINE_SYNC
+	}
+	if depth == 0 {
+		depth = config.DEFAULT_ENGINE_QUEUE_DEPTH
+	}
+	engine, err := ioengine.New(name, depth)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("using the I/O engine '%s'", name))
+	}
+	return engine, nil
+}
+
+// splitBlocks returns the blocks of the buffer, so that they are passed to the I/O engine as one I/O vector each.
+func splitBlocks(buf []byte, blocksize int) [][]byte {
+	blocks := make([][]byte, len(buf)/blocksize)
+	for i := range blocks {
+		blocks[i] = buf[i*blocksize : (i+1)*blocksize]
+	}
+	return blocks
+}
@@ -0,0 +1,54 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/devisions/go-playground/go-directio/codec"
+	"github.com/devisions/go-playground/go-directio/config"
+	"github.com/devisions/go-playground/go-directio/internal/data"
+)
+
+// TestIOStats appends and reads records in a path using direct I/O and in another one using buffered I/O
+// (as if its file system did not support direct I/O), and then checks that the writes and the reads are counted by I/O mode.
+func TestIOStats(t *testing.T) {
+	buffered := newTestConfig(t.TempDir())
+	data.UseBufferedIO(buffered.Path)
+	for mode, cfg := range map[string]*config.Config{data.IO_MODE_DIRECT: newTestConfig(t.TempDir()), data.IO_MODE_BUFFERED: buffered} {
+		w, err := NewWriter(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q, err := NewQueue[string](w, nil, codec.JSON[string]{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := appendTestValues(q, w, 100, 100); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReader(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q, err = NewQueue[string](nil, r, codec.JSON[string]{}); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			if _, err := q.Read(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_ = r.Close()
+		for _, s := range []IOStats{w.IOStats(), r.IOStats()} {
+			ops, bytes, others := s.DirectOps, s.DirectBytes, s.BufferedOps
+			if mode == data.IO_MODE_BUFFERED {
+				ops, bytes, others = s.BufferedOps, s.BufferedBytes, s.DirectOps
+			}
+			if ops == 0 || bytes < ops*int64(cfg.BlockSize) || others != 0 {
+				t.Fatalf("got the stats { %s } using %s I/O", s, mode)
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package queue
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/devisions/go-playground/go-directio/internal/data"
+	"github.com/pkg/errors"
+)
+
+// Maximum number of headers of a record.
+const MAX_HEADERS = 64
+
+// Metadata is the envelope of a record's payload.
+type Metadata struct {
+	// An optional key, for example for routing the records.
+	Key []byte
+	// When the record was produced. If zero, the Writer sets it to the time of appending.
+	Timestamp time.Time
+	// A small map of optional headers.
+	Headers map[string]string
+}
+
+// encodeEnvelope returns the (encoded) data of a record: the metadata followed by the payload.
+// The layout is:
+// - the timestamp as Unix nanoseconds (8 bytes)
+// - the key length (uvarint) and the key bytes
+// - the number of headers (uvarint) and, for each one, the name and the value (each as uvarint length and bytes)
+// - the payload, as the rest of the encoded data
+func encodeEnvelope(md *Metadata, payload []byte) []byte {
+	size := 8 + binary.MaxVarintLen32 + len(md.Key) + binary.MaxVarintLen32 + len(payload)
+	for n, v := range md.Headers {
+		size += 2*binary.MaxVarintLen32 + len(n) + len(v)
+	}
+	ed := make([]byte, size)
+	i := copy(ed, data.I64toBytes(uint64(md.Timestamp.UnixNano())))
+	i += putBytes(ed[i:], md.Key)
+	i += binary.PutUvarint(ed[i:], uint64(len(md.Headers)))
+	for n, v := range md.Headers {
+		i += putBytes(ed[i:], []byte(n))
+		i += putBytes(ed[i:], []byte(v))
+	}
+	i += copy(ed[i:], payload)
+	return ed[:i]
+}
+
+// decodeEnvelope gets the metadata and the payload from the (encoded) data of a record.
+func decodeEnvelope(ed []byte) (*Metadata, []byte, error) {
+	if len(ed) < 8 {
+		return nil, nil, errors.New("the envelope is too short")
+	}
+	md := Metadata{
+		Timestamp: time.Unix(0, int64(data.BytesToI64(ed[:8]))),
+	}
+	i := 8
+	key, n, err := getBytes(ed[i:])
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "getting the key")
+	}
+	if len(key) > 0 {
+		md.Key = key
+	}
+	i += n
+	count, n := binary.Uvarint(ed[i:])
+	if n <= 0 || count > MAX_HEADERS {
+		return nil, nil, errors.New("invalid number of headers")
+	}
+	i += n
+	if count > 0 {
+		md.Headers = make(map[string]string, count)
+	}
+	for h := uint64(0); h < count; h++ {
+		name, n, err := getBytes(ed[i:])
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "getting a header name")
+		}
+		i += n
+		value, n, err := getBytes(ed[i:])
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "getting a header value")
+		}
+		i += n
+		md.Headers[string(name)] = string(value)
+	}
+	return &md, ed[i:], nil
+}
+
+// envelopeTimestamp returns the timestamp (as Unix nanoseconds) from the (encoded) data of a record,
+// without decoding the rest of the envelope. It returns 0 if the envelope is too short.
+func envelopeTimestamp(ed []byte) int64 {
+	if len(ed) < 8 {
+		return 0
+	}
+	return int64(data.BytesToI64(ed[:8]))
+}
+
+// putBytes puts the length (uvarint) and then the bytes of `b` into `to`, returning the number of bytes put.
+func putBytes(to []byte, b []byte) int {
+	n := binary.PutUvarint(to, uint64(len(b)))
+	return n + copy(to[n:], b)
+}
+
+// getBytes gets the bytes put by `putBytes`, returning them and the number of bytes consumed from `from`.
+func getBytes(from []byte) ([]byte, int, error) {
+	l, n := binary.Uvarint(from)
+	if n <= 0 || l > uint64(len(from)-n) {
+		return nil, 0, errors.New("invalid length")
+	}
+	return from[n : n+int(l)], n + int(l), nil
+}
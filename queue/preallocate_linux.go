@@ -0,0 +1,34 @@
+package queue
+
+import (
+	"os"
+	"syscall"
+)
+
+// The fallocate mode that zeroes a range of a file, keeping its blocks allocated (FALLOC_FL_ZERO_RANGE).
+const fallocZeroRange = 0x10
+
+// preallocate allocates the blocks of the file up to `size` (using fallocate), extending the file with zeros if it is smaller.
+// The blocks already allocated are left as they are. It returns `errPreallocateUnsupported` if the file system does not support it.
+func preallocate(f *os.File, size int64) error {
+	return fallocate(f, 0, 0, size)
+}
+
+// zeroRange zeroes `size` bytes of the file from `off` (using fallocate), keeping their blocks allocated.
+// It returns `errPreallocateUnsupported` if the file system does not support it.
+func zeroRange(f *os.File, off int64, size int64) error {
+	return fallocate(f, fallocZeroRange, off, size)
+}
+
+func fallocate(f *os.File, mode uint32, off int64, size int64) error {
+	for {
+		err := syscall.Fallocate(int(f.Fd()), mode, off, size)
+		switch err {
+		case syscall.EINTR:
+			continue
+		case syscall.EOPNOTSUPP, syscall.ENOSYS:
+			return errPreallocateUnsupported
+		}
+		return err
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package queue
+
+import "os"
+
+// preallocate is supported only on Linux.
+func preallocate(f *os.File, size int64) error {
+	return errPreallocateUnsupported
+}
+
+// zeroRange is supported only on Linux.
+func zeroRange(f *os.File, off int64, size int64) error {
+	return errPreallocateUnsupported
+}
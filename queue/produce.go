@@ -0,0 +1,230 @@
+package queue
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/devisions/go-playground/go-directio/internal/data"
+	"github.com/ncw/directio"
+	"github.com/pkg/errors"
+)
+
+// errPreallocateUnsupported tells that the file system does not support preallocating files.
+var errPreallocateUnsupported = errors.New("preallocating files is not supported")
+
+// fileOptions tells how the Writer creates and opens its files (aka segments).
+type fileOptions struct {
+	blocksize int
+	maxsize   int64
+	// Flags added when opening a file (ex: O_DSYNC).
+	flags int
+	// Whether the files get preallocated to `maxsize`, so that writing into them does not extend them.
+	preallocate bool
+	// Whether a new file reuses one of the files recycled by the retention (see `RECYCLED_EXT`), if any.
+	recycle bool
+}
+
+// preallocateFile preallocates the file, if configured to. If the file system does not support it,
+// preallocating gets disabled (with a warning), so that the files are extended while written.
+func (o *fileOptions) preallocateFile(f *os.File) error {
+	if !o.preallocate {
+		return nil
+	}
+	err := preallocate(f, o.maxsize)
+	if err == errPreallocateUnsupported {
+		log.Printf("[WARN] Not preallocating the files anymore, as it is not supported for file %s.\n", f.Name())
+		o.preallocate = false
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("preallocating file %s", f.Name()))
+	}
+	return nil
+}
+
+// getInitialFileForWriting returns the latest file, if it can still be written into.
+// Otherwise, it seals the latest file (if needed) and returns a new one.
+// A torn tail of the latest file, left by a crash while writing, gets discarded (see `discardTornTail`).
+// It also returns the info about the records of the returned file, that is positioned where the next block gets written.
+func getInitialFileForWriting(path string, opts *fileOptions) (*os.File, *segmentInfo, error) {
+	file, err := getLatestFileNameForWriting(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return openNewFileForWriting(path, 0, opts)
+		}
+		return nil, nil, errors.Wrap(err, "trying to get new file for writing")
+	}
+	filepath := path + string(os.PathSeparator) + file
+	// Checking the header, the records and the size before returning it.
+	info, err := scanSegment(filepath, opts.blocksize)
+	reason := ""
+	if cerr, ok := err.(*CorruptionError); ok {
+		reason = fmt.Sprintf("corrupted record at position %d (%s)", cerr.Offset, cerr.Reason)
+	} else if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	if info != nil && info.sealed {
+		return openNewFileForWriting(path, info.nextOffset, opts)
+	}
+	if info != nil {
+		if info.incomplete {
+			reason = "incomplete record"
+		}
+		if err := discardTornTail(filepath, opts, info, reason); err != nil {
+			return nil, nil, errors.Wrap(err, fmt.Sprintf("discarding the torn tail of file %s", filepath))
+		}
+	}
+	f, err := data.OpenFileForWriting(filepath, false, opts.flags)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info == nil {
+		// The file was created, but its header didn't get to be written.
+		base, err := getBaseOffsetOfFilename(filepath)
+		if err != nil {
+			_ = f.Close()
+			return nil, nil, errors.Wrap(err, "getting the base offset from the file name")
+		}
+		if err := f.Truncate(0); err != nil {
+			_ = f.Close()
+			return nil, nil, errors.Wrap(err, "truncating the file without header")
+		}
+		if err := writeSegmentHeader(f, opts.blocksize, base); err != nil {
+			_ = f.Close()
+			return nil, nil, err
+		}
+		if err := opts.preallocateFile(f); err != nil {
+			_ = f.Close()
+			return nil, nil, err
+		}
+		log.Println("[WARN] Rewrote the header of file", filepath, "as it didn't get to be (completely) written.")
+		info = newSegmentInfo(base, opts.blocksize)
+	}
+	// The indexes might be missing entries of the last written records or have entries of the unwritten ones.
+	if err := writeIndexFiles(filepath, info.index); err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+	// The file might be preallocated, so the next block is not necessarily written at its end.
+	if _, err := f.Seek(info.size(opts.blocksize), 0); err != nil {
+		_ = f.Close()
+		return nil, nil, errors.Wrap(err, "seeking to the position of the next block")
+	}
+	if info.size(opts.blocksize) >= opts.maxsize {
+		// The file is full, but it didn't get to be sealed.
+		err := writeEndOfSegment(f, opts.blocksize, info.nextOffset)
+		_ = f.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		return openNewFileForWriting(path, info.nextOffset, opts)
+	}
+	return f, info, nil
+}
+
+// discardTornTail truncates the file right after the block containing its last complete record, discarding an incomplete
+// record (ex: the previous run died in the middle of writing a record that spans several blocks), a corrupted one
+// (as `reason` tells) and anything after it, including a partially written block. If anything got discarded,
+// the rest of the block containing the end of the last complete record becomes padding.
+// A preallocated file gets preallocated again, so its blocks after the last record are zeros: nothing written yet.
+// Nothing is done if there is nothing after the last record.
+func discardTornTail(filepath string, opts *fileOptions, info *segmentInfo, reason string) error {
+	fi, err := os.Stat(filepath)
+	if err != nil {
+		return err
+	}
+	bs := int64(opts.blocksize)
+	size := info.size(opts.blocksize)
+	if reason == "" && fi.Size() == size {
+		return nil
+	}
+	if reason == "" && !opts.preallocate {
+		reason = "partially written block"
+	}
+	f, err := data.OpenFileForWriting(filepath, false, 0)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	if rem := info.end % bs; rem > 0 && reason != "" {
+		block := directio.AlignedBlock(opts.blocksize)
+		in, err := data.OpenFileForReading(filepath)
+		if err != nil {
+			return err
+		}
+		_, err = in.ReadAt(block, info.end-rem)
+		_ = in.Close()
+		if err != nil {
+			return errors.Wrap(err, "reading the block of the last complete record")
+		}
+		for i := rem; i < bs; i++ {
+			block[i] = 0
+		}
+		if bs-rem >= recordHeaderSize {
+			putRecordHeader(block[rem:], recordHeader{kind: recordKindPadding, offset: info.nextOffset}, nil)
+		}
+		if _, err := f.WriteAt(block, info.end-rem); err != nil {
+			return errors.Wrap(err, "padding the block of the last complete record")
+		}
+	}
+	if err := f.Truncate(size); err != nil {
+		return errors.Wrap(err, "truncating the file")
+	}
+	if err := opts.preallocateFile(f); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return errors.Wrap(err, "syncing the file")
+	}
+	if reason != "" {
+		log.Printf("[WARN] Discarded the last %d bytes of file %s, after position %d (%s). The next record gets offset %d.\n",
+			fi.Size()-info.end, filepath, info.end, reason, info.nextOffset)
+	}
+	return nil
+}
+
+// openNewFileForWriting creates a new file (aka segment), named after the offset of its first record, starting with its header.
+// If configured to, it reuses a recycled file instead. It also creates the (empty) indexes of the file.
+// The returned file is positioned right after its header.
+func openNewFileForWriting(path string, baseOffset uint64, opts *fileOptions) (*os.File, *segmentInfo, error) {
+	filepath := path + string(os.PathSeparator) + segmentFileName(baseOffset)
+	reused := false
+	if opts.recycle {
+		var err error
+		if reused, err = reuseRecycledFile(path, filepath, baseOffset, opts); err != nil {
+			return nil, nil, err
+		}
+	}
+	f, err := data.OpenFileForWriting(filepath, false, opts.flags)
+	if err != nil {
+		return nil, nil, err
+	}
+	if reused {
+		_, err = f.Seek(int64(opts.blocksize), 0)
+	} else if err = writeSegmentHeader(f, opts.blocksize, baseOffset); err == nil {
+		err = opts.preallocateFile(f)
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+	info := newSegmentInfo(baseOffset, opts.blocksize)
+	if err := writeIndexFiles(filepath, info.index); err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+	return f, info, nil
+}
+
+func getLatestFileNameForWriting(iopath string) (string, error) {
+	fnames, err := getSegmentFileNames(iopath)
+	if err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("looking for files on path '%s'", iopath))
+	}
+	if len(fnames) == 0 {
+		return "", os.ErrNotExist
+	}
+	return fnames[len(fnames)-1], nil
+}
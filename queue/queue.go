@@ -0,0 +1,190 @@
+package queue
+
+import (
+	"fmt"
+
+	"github.com/devisions/go-playground/go-directio/codec"
+	"github.com/pkg/errors"
+)
+
+// Queue is a typed layer on top of a Writer and/or a Reader,
+// that encodes and decodes the values of type T using codecs.
+// Like the Writer and the Reader, a Queue is not safe for concurrent use.
+type Queue[T any] struct {
+	w *Writer
+	r *Reader
+
+	// The codec used for writing.
+	codec codec.Codec[T]
+
+	// The codecs used for reading, by their ID.
+	codecs map[byte]codec.Codec[T]
+}
+
+// Item is a value read from a Queue, along with the record that contained it.
+type Item[T any] struct {
+	Value T
+	*ReadData
+}
+
+// NewQueue creates a Queue that writes using `w` and reads using `r`. Any of them can be nil, if not needed.
+// The first codec is used for writing, while all of them are used for reading, according to each record's codec id.
+func NewQueue[T any](w *Writer, r *Reader, codecs ...codec.Codec[T]) (*Queue[T], error) {
+	if len(codecs) == 0 {
+		return nil, errors.New("at least one codec is needed")
+	}
+	q := Queue[T]{
+		w:      w,
+		r:      r,
+		codec:  codecs[0],
+		codecs: make(map[byte]codec.Codec[T], len(codecs)),
+	}
+	for _, c := range codecs {
+		if c.ID() == codec.RawID {
+			return nil, errors.New(fmt.Sprintf("codec '%s' cannot use the id reserved for raw payloads", c.Name()))
+		}
+		q.codecs[c.ID()] = c
+	}
+	return &q, nil
+}
+
+// Write encodes the value and appends it using the Writer.
+func (q *Queue[T]) Write(v T) error {
+	return q.WriteWithMetadata(v, nil)
+}
+
+// WriteWithMetadata is like `Write`, storing the metadata next to the encoded value.
+func (q *Queue[T]) WriteWithMetadata(v T, md *Metadata) error {
+	if q.w == nil {
+		return errors.New("the queue has no writer")
+	}
+	ed, err := q.codec.Encode(v)
+	if err != nil {
+		return err
+	}
+	return q.w.appendData(q.codec.ID(), 0, 0, md, ed)
+}
+
+// WriteBatch encodes the values and appends them as a group, using the Writer (see `Writer.AppendBatch`).
+func (q *Queue[T]) WriteBatch(values []T) error {
+	if q.w == nil {
+		return errors.New("the queue has no writer")
+	}
+	return q.w.appendBatch(len(values), func(i int) (byte, []byte, error) {
+		ed, err := q.codec.Encode(values[i])
+		return q.codec.ID(), ed, err
+	})
+}
+
+// WriteIdempotent is like `WriteWithMetadata` (`md` can be nil), for an idempotent producer (see `Writer.AppendIdempotent`).
+// A duplicate is rejected with a `DuplicateError`.
+func (q *Queue[T]) WriteIdempotent(producerID uint32, sequence uint64, v T, md *Metadata) error {
+	if q.w == nil {
+		return errors.New("the queue has no writer")
+	}
+	if producerID == 0 {
+		return errReservedProducerID
+	}
+	ed, err := q.codec.Encode(v)
+	if err != nil {
+		return err
+	}
+	return q.w.appendData(q.codec.ID(), producerID, sequence, md, ed)
+}
+
+// Read reads the next record using the Reader and decodes its value.
+// Like `Reader.Read`, it returns `os.ErrNotExist` or `io.EOF` when there is nothing to read for now.
+func (q *Queue[T]) Read() (*Item[T], error) {
+	if q.r == nil {
+		return nil, errors.New("the queue has no reader")
+	}
+	rd, err := q.r.Read()
+	if err != nil {
+		return nil, err
+	}
+	return q.decode(rd)
+}
+
+// decode decodes the value of the read record, using the codec it was written with.
+func (q *Queue[T]) decode(rd *ReadData) (*Item[T], error) {
+	c, found := q.codecs[rd.CodecID]
+	if !found {
+		return nil, errors.New(fmt.Sprintf("no codec having id %d to decode the record from file %s", rd.CodecID, rd.FromFilepath))
+	}
+	v, err := c.Decode(rd.Payload)
+	if err != nil {
+		return nil, err
+	}
+	return &Item[T]{Value: v, ReadData: rd}, nil
+}
+
+// Handler processes a value read from a Queue. Returning an error tells that the value was not processed.
+type Handler[T any] func(item *Item[T]) error
+
+// HandlerError is returned by `Queue.Consume` when the handler failed to process a value.
+type HandlerError struct {
+	// The offset of the record that contains the value.
+	Offset uint64
+	// The error returned by the handler.
+	Err error
+}
+
+func (e *HandlerError) Error() string {
+	return fmt.Sprintf("handling the record having offset %d: %s", e.Offset, e.Err)
+}
+
+// Cause returns the error returned by the handler.
+func (e *HandlerError) Cause() error {
+	return e.Err
+}
+
+// DecodeError is returned by `Queue.Consume` when the value of a record cannot be decoded.
+type DecodeError struct {
+	// The record that contains the value.
+	Record *ReadData
+	// The decoding error.
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decoding the record having offset %d: %s", e.Record.Offset, e.Err)
+}
+
+// Cause returns the decoding error.
+func (e *DecodeError) Cause() error {
+	return e.Err
+}
+
+// Consume reads the next value and passes it to `handle`. Only if `handle` succeeds, the position right after
+// the value gets committed (see `Reader.Commit`). Otherwise, the Reader goes back to the value, so that the next
+// call delivers it again, and a `HandlerError` is returned. If the value cannot be decoded, decoding it again would
+// fail as well, so the record gets skipped (its position committed) and a `DecodeError` holding it is returned
+// (ex: for keeping it aside). Like `Reader.Read`, it returns `os.ErrNotExist` or `io.EOF` when there is nothing to read for now.
+//
+// This gives an at-least-once delivery: a value is delivered again until it gets acknowledged (by `handle`
+// succeeding), even across restarts, since the committed position is the one a new Reader starts from.
+// Therefore, a value can be delivered more than once: when the process dies after `handle` succeeded
+// but before the commit got saved, or when a failed `handle` had (partially) processed it.
+func (q *Queue[T]) Consume(handle Handler[T]) error {
+	if q.r == nil {
+		return errors.New("the queue has no reader")
+	}
+	rd, err := q.r.Read()
+	if err != nil {
+		return err
+	}
+	item, err := q.decode(rd)
+	if err != nil {
+		if cerr := q.r.Commit(rd); cerr != nil {
+			return errors.Wrap(cerr, fmt.Sprintf("skipping the record having offset %d, that failed to be decoded", rd.Offset))
+		}
+		return &DecodeError{Record: rd, Err: err}
+	}
+	if err := handle(item); err != nil {
+		if serr := q.r.SeekToOffset(item.Offset); serr != nil {
+			return errors.Wrap(serr, fmt.Sprintf("going back to the record having offset %d, that failed to be handled", item.Offset))
+		}
+		return &HandlerError{Offset: item.Offset, Err: err}
+	}
+	return q.r.Commit(item.ReadData)
+}
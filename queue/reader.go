@@ -0,0 +1,514 @@
+package queue
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/devisions/go-playground/go-directio/config"
+	"github.com/devisions/go-playground/go-directio/internal/data"
+	"github.com/devisions/go-playground/go-directio/ioengine"
+	"github.com/ncw/directio"
+	"github.com/pkg/errors"
+)
+
+// Maximum value of encoded data length (65KB).
+const MAX_EDL = 65 * 1024
+
+// How many times a seemingly corrupted record of the latest file gets read again (see `Reader.Read`),
+// while the file does not grow, before the `CorruptionError` is returned.
+const MAX_REREADS = 10
+
+// Reader reads (consumes) the files of a path - one by one - and keeps its position,
+// as the offset of the next record to read, in a `ConsumerState`, so that it can resume the work any time.
+// A Reader is not safe for concurrent use.
+type Reader struct {
+	// The blocks of the (aligned) buffer (re)used for reading several blocks at once (see `IO_READ_BUFFER_BYTES`).
+	blocks [][]byte
+
+	// Size of a block.
+	blocksize int
+
+	// Paths where the files to read from exist: the configured path and,
+	// when replaying from the archive, the archive path before it.
+	dirs []string
+
+	// The I/O mode of the files of the configured path: direct I/O or, if the path does not support it, buffered I/O.
+	ioMode string
+
+	// The current file to read from.
+	in *segmentReader
+
+	// Reads the blocks of the files (except for the compressed ones).
+	engine ioengine.Engine
+
+	// Reads done so far, by I/O mode.
+	ioStats IOStats
+
+	// Whether the end of the current file was reached.
+	sealed bool
+
+	// Saves the commits to the state (of the consumer), according to the commit policy.
+	commits *committer
+
+	// Offset of the next record to read.
+	next uint64
+
+	// If not zero, the records having an older timestamp (as Unix nanoseconds) are skipped, until a newer one is read.
+	since int64
+
+	// Whether only the records of the committed transactions are read (besides the ones not part of any).
+	readCommitted bool
+
+	// In read committed mode, the records of the open transaction, read so far, and the ones
+	// of the last committed transaction, not returned yet.
+	uncommitted []*ReadData
+	committed   []*ReadData
+
+	// Whether the "waiting for a file" warning is still to be shown.
+	showInitialWarn bool
+
+	// The seemingly corrupted record of the latest file that is being read again, the size of its file
+	// when last read and how many times it was read again since then.
+	rereadErr  *CorruptionError
+	rereadSize int64
+	rereads    int
+}
+
+// NewReader creates a Reader of the files in the configured path (creating it, if missing),
+// starting from the previously saved state, if any.
+// If configured, the Reader also reads the (older) files that were moved into the archive path.
+// The block size gets validated or, if 0, set, according to the direct I/O alignment of the path (see `ResolveBlockSize`).
+// It fails if the path does not support direct I/O, unless the direct I/O policy allows falling back to buffered I/O.
+func NewReader(cfg *config.Config) (*Reader, error) {
+	cp, err := newCommitPolicy(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "using the commit policy")
+	}
+	if _, err := data.MakePathIfNotExists(cfg.Path); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("creating (missing) path '%s' for reading files from", cfg.Path))
+	}
+	if err := ResolveBlockSize(cfg); err != nil {
+		return nil, err
+	}
+	bufsize := cfg.ReadBufferBytes
+	if bufsize == 0 {
+		bufsize = cfg.BlockSize
+	}
+	if bufsize < 0 || bufsize%cfg.BlockSize != 0 {
+		return nil, errors.New(fmt.Sprintf("%s %d is not a positive multiple of the block size of %d bytes", config.IO_READ_BUFFER_BYTES, bufsize, cfg.BlockSize))
+	}
+	ioMode, err := selectIOMode(cfg.Path, cfg.BlockSize, cfg.DirectIOPolicy)
+	if err != nil {
+		return nil, err
+	}
+	s, err := initConsumerState(cfg.Path, cfg.ConsumerName, cfg.BlockSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "initializing the state")
+	}
+	engine, err := newEngine(cfg)
+	if err != nil {
+		return nil, err
+	}
+	r := Reader{
+		dirs:            []string{cfg.Path},
+		ioMode:          ioMode,
+		engine:          engine,
+		next:            s.NextOffset,
+		readCommitted:   cfg.ConsumerReadCommitted,
+		showInitialWarn: true,
+	}
+	r.blocksize = cfg.BlockSize
+	r.blocks = splitBlocks(directio.AlignedBlock(bufsize), cfg.BlockSize)
+	if cfg.ConsumerReplayArchive && cfg.ArchivePath != "" {
+		r.dirs = []string{cfg.ArchivePath, cfg.Path}
+		// Nothing got archived yet, if the archive path is missing.
+		if _, err := os.Stat(cfg.ArchivePath); err == nil {
+			if _, err := selectIOMode(cfg.ArchivePath, cfg.BlockSize, cfg.DirectIOPolicy); err != nil {
+				_ = engine.Close()
+				return nil, err
+			}
+		}
+	}
+	r.commits = newCommitter(cp, s)
+	return &r, nil
+}
+
+// Blocksize returns the size of the block used for reading.
+func (r *Reader) Blocksize() int {
+	return r.blocksize
+}
+
+// State returns (a copy of) the state of the consumer, as last saved.
+func (r *Reader) State() *ConsumerState {
+	return r.commits.saved()
+}
+
+// CommitPolicy returns the policy of saving the commits to the state.
+func (r *Reader) CommitPolicy() CommitPolicy {
+	return r.commits.policy
+}
+
+// IOMode returns the I/O mode of the files: `data.IO_MODE_DIRECT` or `data.IO_MODE_BUFFERED`.
+func (r *Reader) IOMode() string {
+	return r.ioMode
+}
+
+// IOStats returns the reads (of blocks) done so far, by I/O mode: direct I/O or buffered I/O (see `IOMode`).
+func (r *Reader) IOStats() IOStats {
+	return r.ioStats
+}
+
+// Engine returns the name of the I/O engine that the blocks get read with.
+func (r *Reader) Engine() string {
+	return r.engine.Name()
+}
+
+// NextOffset returns the offset of the next record to read.
+func (r *Reader) NextOffset() uint64 {
+	return r.next
+}
+
+// ReadCommitted tells if the Reader reads only the records of the committed transactions (besides the ones not part of any).
+func (r *Reader) ReadCommitted() bool {
+	return r.readCommitted
+}
+
+// Read reads the next record.
+// It returns `os.ErrNotExist` if there is no file to read from yet
+// and `io.EOF` if there is nothing else to read for now.
+// In read committed mode, the records of a transaction are held back (in memory) until it gets committed
+// and dropped if it gets aborted, while the transaction markers are never returned.
+func (r *Reader) Read() (*ReadData, error) {
+	if r.in == nil {
+		if err := r.open(); err != nil {
+			return nil, err
+		}
+		if r.in == nil {
+			return nil, os.ErrNotExist
+		}
+	}
+	return r.readIn()
+}
+
+// SeekToOffset moves the Reader to the record having `offset`, so that it is the next one read.
+// It uses the index of the file that contains the record, to avoid reading the records before it.
+// The state gets updated on the next `Commit`.
+func (r *Reader) SeekToOffset(offset uint64) error {
+	if err := r.closeIn(); err != nil {
+		log.Printf("[WARN] Failed to close existing file '%s'. Reason:%s\n", r.in.name(), err)
+	}
+	r.in = nil
+	r.sealed = false
+	r.next = offset
+	r.since = 0
+	r.uncommitted, r.committed = nil, nil
+	return r.open()
+}
+
+// SeekToTime moves the Reader to the first record having a timestamp at or after `t`, so that it is the next one read.
+// The files are filtered by their creation time, then the time index of the chosen file is used for
+// skipping the records that are older. Timestamps are expected to follow the order in which the
+// records were appended, as it happens when the Writer sets them. The state gets updated on the next `Commit`.
+func (r *Reader) SeekToTime(t time.Time) error {
+	if err := r.closeIn(); err != nil {
+		log.Printf("[WARN] Failed to close existing file '%s'. Reason:%s\n", r.in.name(), err)
+	}
+	r.in = nil
+	r.sealed = false
+	r.since = t.UnixNano()
+	r.uncommitted, r.committed = nil, nil
+	fp, err := getFilepathForReadingSince(r.dirs, t, r.blocksize)
+	if err != nil {
+		if err != os.ErrNotExist {
+			return errors.Wrap(err, "looking for the file to read from")
+		}
+		return nil // The records to be appended are going to be filtered.
+	}
+	sr, err := r.openSegment(fp)
+	if err == io.EOF {
+		return nil // Its header is not written yet.
+	}
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("using the file found '%s'", fp))
+	}
+	r.next = sr.base
+	entries, err := loadTimeIndex(fp, sr.base, r.blocksize)
+	if err != nil {
+		_ = sr.close()
+		return errors.Wrap(err, fmt.Sprintf("loading the time index of file '%s'", fp))
+	}
+	if e, found := lookupTimeIndex(entries, r.since); found && e.offset > sr.base {
+		sr.seek(e.indexEntry)
+		r.next = e.offset
+	}
+	log.Println("Reading from file", sr.name(), "starting with offset", r.next, "and skipping the records older than", t.Format(time.RFC3339Nano))
+	r.in = sr
+	return nil
+}
+
+// Commit updates the state with the offset that follows the provided (consumed) data and saves it,
+// right away or later, according to the commit policy (see `CommitPolicy`).
+// It acknowledges that the data (and all before it) got processed: a new Reader of the same consumer starts
+// right after the last saved commit. See `Queue.Consume` for committing only after the data got processed.
+// It returns the error of a previous save that failed in the background, if any.
+func (r *Reader) Commit(rd *ReadData) error {
+	return r.commits.commit(rd.Offset + 1)
+}
+
+// FlushCommits saves the last commit now, if not already saved (ex: in COMMIT_EXPLICIT mode).
+func (r *Reader) FlushCommits() error {
+	return r.commits.save()
+}
+
+// Close saves the last commit (if not already saved) and closes the file currently read from, and the I/O engine.
+// The Reader cannot be used after being closed.
+func (r *Reader) Close() error {
+	err := r.commits.close()
+	if cerr := r.closeIn(); err == nil {
+		err = cerr
+	}
+	if cerr := r.engine.Close(); err == nil && cerr != nil {
+		err = errors.Wrap(cerr, "closing the I/O engine")
+	}
+	return err
+}
+
+// closeIn closes the file currently read from.
+func (r *Reader) closeIn() error {
+	if r.in == nil {
+		return nil
+	}
+	return r.in.close()
+}
+
+// open looks for the file to start reading from: the one containing the next offset
+// to read, according to the state. It leaves `r.in` nil if none exists yet.
+// Within the file, it starts from the closest indexed record before the next offset.
+func (r *Reader) open() error {
+	fp, err := getFilepathForReading(r.dirs, r.next)
+	if err != nil {
+		if err != os.ErrNotExist {
+			return errors.Wrap(err, "looking for the file to read from")
+		}
+		if r.showInitialWarn {
+			log.Println("Didn't found a file to read from yet ...")
+			r.showInitialWarn = false
+		}
+		return nil
+	}
+	sr, err := r.openSegment(fp)
+	if err == io.EOF {
+		return nil // Its header is not written yet.
+	}
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("using the file found '%s'", fp))
+	}
+	if sr.base > r.next {
+		log.Printf("[WARN] The records from offset %d to %d are missing.\n", r.next, sr.base-1)
+		r.next = sr.base
+	}
+	if sr.base < r.next {
+		if err := r.seekIn(sr); err != nil {
+			_ = sr.close()
+			return err
+		}
+	} else {
+		log.Println("Reading from file", sr.name())
+	}
+	r.in = sr
+	return nil
+}
+
+// openSegment opens the file for reading its records, counting the reads in the Reader's stats.
+func (r *Reader) openSegment(fp string) (*segmentReader, error) {
+	sr, err := openSegmentReader(fp, r.blocks, r.engine)
+	if err != nil {
+		return nil, err
+	}
+	sr.stats = &r.ioStats
+	return sr, nil
+}
+
+// seekIn moves the segment reader to the closest indexed record before the next offset to read.
+func (r *Reader) seekIn(sr *segmentReader) error {
+	entries, err := loadIndex(sr.name(), sr.base, r.blocksize)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("loading the index of file '%s'", sr.name()))
+	}
+	e, found := lookupIndex(entries, r.next)
+	if !found || e.offset == sr.base {
+		log.Println("Reading from file", sr.name(), "and skipping", r.next-sr.base, "records")
+		return nil
+	}
+	sr.seek(e)
+	log.Println("Reading from file", sr.name(), "at position", e.position(), "and skipping", r.next-e.offset, "records")
+	return nil
+}
+
+func (r *Reader) readIn() (*ReadData, error) {
+	for {
+		if len(r.committed) > 0 {
+			rd := r.committed[0]
+			r.committed = r.committed[1:]
+			return rd, nil
+		}
+		if r.sealed {
+			if err := r.useNextFile(); err != nil {
+				return nil, err
+			}
+		}
+		rec, err := r.in.next()
+		if cerr, ok := err.(*CorruptionError); ok {
+			rec, err = r.reread(cerr)
+		} else if err == io.EOF && r.in.pending != nil {
+			rec, err = r.rereadPending()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if rec.kind == recordKindEnd {
+			r.sealed = true
+			continue
+		}
+		if rec.offset < r.next {
+			continue // Already read.
+		}
+		if isMarker(rec.kind) {
+			r.next = rec.offset + 1
+			r.endTransaction(rec.kind)
+			continue
+		}
+		if r.since != 0 {
+			if envelopeTimestamp(rec.ed) < r.since {
+				r.next = rec.offset + 1
+				continue
+			}
+			r.since = 0
+		}
+		md, payload, err := decodeEnvelope(rec.ed)
+		if err != nil {
+			return nil, &CorruptionError{Segment: r.in.name(), Offset: rec.pos, Reason: err.Error()}
+		}
+		r.next = rec.offset + 1
+		rd := &ReadData{
+			Metadata:     *md,
+			Payload:      payload,
+			CodecID:      rec.codec,
+			Offset:       rec.offset,
+			ProducerID:   rec.producerID,
+			Sequence:     rec.sequence,
+			FromFilepath: r.in.name(),
+		}
+		if r.readCommitted && rec.flags&recordFlagTransactional != 0 {
+			r.uncommitted = append(r.uncommitted, rd)
+			continue
+		}
+		return rd, nil
+	}
+}
+
+// endTransaction handles, in read committed mode, the transaction marker of `kind`: on commit, the records
+// of the transaction become readable, while on abort they get dropped.
+func (r *Reader) endTransaction(kind byte) {
+	if !r.readCommitted {
+		return
+	}
+	switch kind {
+	case recordKindBegin:
+		if len(r.uncommitted) > 0 {
+			log.Printf("[WARN] Dropped %d records of a transaction that was neither committed nor aborted.\n", len(r.uncommitted))
+		}
+	case recordKindCommit:
+		r.committed = r.uncommitted
+	}
+	// On abort, the records of the transaction get dropped.
+	r.uncommitted = nil
+}
+
+// reread reads again the record that seemed corrupted. While a file is being written, anything might follow its
+// last record (ex: a block being written while read), so it is taken as not written yet (returning `io.EOF`),
+// to be read again later, unless it was already read again `MAX_REREADS` times while its file did not grow. Once a next file exists, the current one is completely written,
+// so reading the record again tells if it is really corrupted.
+func (r *Reader) reread(cerr *CorruptionError) (*record, error) {
+	if r.in.compressed() {
+		return nil, cerr // An archived file is completely written.
+	}
+	_, err := getNextFilepathForReading(r.dirs, r.in.name())
+	if err != nil && err != os.ErrNotExist {
+		return nil, err
+	}
+	r.in.rewind(cerr.Offset)
+	if err == os.ErrNotExist {
+		stuck, err := r.stuck(cerr)
+		if err != nil {
+			return nil, err
+		}
+		if stuck {
+			return nil, cerr
+		}
+		return nil, io.EOF
+	}
+	return r.in.next()
+}
+
+// rereadPending reads again the record whose blocks are not all written yet, if a next file exists: the current one is
+// completely written then, so the record is corrupted (ex: the file got truncated), unless its blocks got written meanwhile.
+func (r *Reader) rereadPending() (*record, error) {
+	if !r.in.compressed() {
+		_, err := getNextFilepathForReading(r.dirs, r.in.name())
+		if err == os.ErrNotExist {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		rec, err := r.in.next()
+		if err != io.EOF || r.in.pending == nil {
+			return rec, err
+		}
+	}
+	return nil, &CorruptionError{Segment: r.in.name(), Offset: r.in.pending.pos, Reason: "incomplete record"}
+}
+
+// stuck tells if the seemingly corrupted record was already read again `MAX_REREADS` times, while its file did not grow.
+func (r *Reader) stuck(cerr *CorruptionError) (bool, error) {
+	fi, err := r.in.f.Stat()
+	if err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("getting the size of file '%s'", r.in.name()))
+	}
+	if r.rereadErr == nil || *r.rereadErr != *cerr || r.rereadSize != fi.Size() {
+		r.rereadErr, r.rereadSize, r.rereads = cerr, fi.Size(), 0
+	}
+	r.rereads++
+	return r.rereads > MAX_REREADS, nil
+}
+
+// useNextFile moves from the current file, that is sealed, to the next one.
+// It returns `os.ErrNotExist` or `io.EOF` if the next file is not created or its header is not written yet.
+func (r *Reader) useNextFile() error {
+	fp, err := getNextFilepathForReading(r.dirs, r.in.name())
+	if err != nil {
+		return err
+	}
+	sr, err := r.openSegment(fp)
+	if err != nil {
+		return err
+	}
+	if err := r.in.close(); err != nil {
+		log.Printf("[WARN] Failed to close existing file '%s'. Reason:%s\n", r.in.name(), err)
+	}
+	log.Println("Reading from new file", sr.name())
+	// The end record of the sealed file has the offset that the next file starts with.
+	if sr.base != r.in.expected {
+		log.Printf("[WARN] The next file starts at offset %d instead of %d.\n", sr.base, r.in.expected)
+		if sr.base > r.next {
+			r.next = sr.base
+		}
+	}
+	r.in = sr
+	r.sealed = false
+	return nil
+}
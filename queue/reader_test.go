@@ -0,0 +1,58 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/devisions/go-playground/go-directio/codec"
+)
+
+// TestPreallocatedTail appends a record that spans several blocks into a preallocated file, so that the blocks holding
+// its beginning get written while the rest of it stays in the Writer's buffer, and then checks that a Reader that caught up
+// takes the record as not written yet (polling more than `MAX_REREADS` times) until it gets written.
+func TestPreallocatedTail(t *testing.T) {
+	cfg := newTestConfig(t.TempDir())
+	cfg.MaxFileSizeBytes = 1024 * 1024
+	cfg.Preallocate = true
+	w, err := NewWriter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = w.Close() }()
+	q, err := NewQueue[string](w, nil, codec.JSON[string]{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := appendTestValues(q, w, 10, 100); err != nil {
+		t.Fatal(err)
+	}
+	// The write buffer gets full in the middle of the record, so only its first blocks get written.
+	if err := q.Write(testValue(10, 3*cfg.WriteBufferBytes)); err != nil {
+		t.Fatal(err)
+	}
+	if w.full*w.blocksize+w.used == 0 {
+		t.Fatal("the record got written completely")
+	}
+
+	c, err := newConsumer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	for i := 0; i <= MAX_REREADS; i++ {
+		if err := c.consumeAll(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.next != 10 {
+		t.Fatalf("got %d records, instead of 10", c.next)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.consumeAll(); err != nil {
+		t.Fatal(err)
+	}
+	if c.next != 11 {
+		t.Fatalf("got %d records, instead of 11", c.next)
+	}
+}
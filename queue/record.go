@@ -0,0 +1,134 @@
+package queue
+
+import (
+	"fmt"
+	"hash/crc32"
+
+	"github.com/devisions/go-playground/go-directio/internal/data"
+)
+
+// Size of a record's header:
+// - the encoded data length (4 bytes)
+// - the kind of the record (1 byte)
+// - the id of the codec used for encoding the data (1 byte)
+// - flags (1 byte)
+// - reserved (1 byte)
+// - the offset of the record in the whole log (8 bytes)
+// - the id of the (idempotent) producer that appended the record, or 0 (4 bytes)
+// - the sequence number of the record, among the ones of its producer (8 bytes)
+// - the checksum of all the above and of the encoded data (4 bytes)
+const recordHeaderSize = 32
+
+// Kinds of records.
+const (
+	// Zeros are never written as a record, so they tell that nothing was written there yet
+	// (ex: the unwritten blocks of a preallocated segment).
+	recordKindNone = 0
+	// Record that holds (encoded) data.
+	recordKindData = 1
+	// Record that marks the end of a segment (aka sealed segment). It has no data,
+	// and its offset is the one of the first record of the next segment.
+	recordKindEnd = 2
+	// Records (aka markers) that mark the beginning, the commit and the abort of a transaction.
+	// They have no data, but they get an offset (like the data records).
+	recordKindBegin  = 3
+	recordKindCommit = 4
+	recordKindAbort  = 5
+	// Record that pads the tail of a block: the rest of the block is unused. It has no data and its offset
+	// is the one of the next record. A tail shorter than a record's header is unused, without padding.
+	recordKindPadding = 6
+)
+
+// Flags of a record.
+const (
+	// The (data) record is part of a transaction, so it counts only if the transaction gets committed.
+	recordFlagTransactional = 1
+)
+
+// recordHeader holds the fields of a record's header, except for the encoded data length and the checksum.
+type recordHeader struct {
+	kind  byte
+	codec byte
+	flags byte
+	// The offset of the record in the whole log.
+	offset uint64
+	// The id of the (idempotent) producer that appended the record (0 if none) and the record's sequence number.
+	producerID uint32
+	sequence   uint64
+}
+
+// isMarker tells if the record of `kind` is a transaction marker.
+func isMarker(kind byte) bool {
+	return kind == recordKindBegin || kind == recordKindCommit || kind == recordKindAbort
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// putRecordHeader puts into `to` the header `h` of a record having `ed` as (encoded) data.
+func putRecordHeader(to []byte, h recordHeader, ed []byte) {
+	copy(to[0:4], data.I32toBytes(uint32(len(ed))))
+	to[4] = h.kind
+	to[5] = h.codec
+	to[6] = h.flags
+	to[7] = 0
+	copy(to[8:16], data.I64toBytes(h.offset))
+	copy(to[16:20], data.I32toBytes(h.producerID))
+	copy(to[20:28], data.I64toBytes(h.sequence))
+	copy(to[28:32], data.I32toBytes(recordChecksum(to[:28], ed)))
+}
+
+// decodeRecordHeader gets the fields from a record's `header`.
+func decodeRecordHeader(header []byte) recordHeader {
+	return recordHeader{
+		kind:       header[4],
+		codec:      header[5],
+		flags:      header[6],
+		offset:     data.BytesToI64(header[8:16]),
+		producerID: data.BytesToI32(header[16:20]),
+		sequence:   data.BytesToI64(header[20:28]),
+	}
+}
+
+// recordLength returns the encoded data length from a record's `header`.
+func recordLength(header []byte) int {
+	return int(data.BytesToI32(header[0:4]))
+}
+
+// recordChecksum returns the CRC32C of a record's header (without the checksum) and encoded data.
+func recordChecksum(header []byte, ed []byte) uint32 {
+	crc := crc32.Update(0, crc32cTable, header)
+	return crc32.Update(crc, crc32cTable, ed)
+}
+
+// crc32cOf returns the CRC32C of `b`.
+func crc32cOf(b []byte) uint32 {
+	return crc32.Checksum(b, crc32cTable)
+}
+
+// verifyRecord checks that the checksum stored in the record's `header` matches its encoded data.
+func verifyRecord(header []byte, ed []byte) bool {
+	return data.BytesToI32(header[28:32]) == recordChecksum(header[:28], ed)
+}
+
+// recordEnd returns the position right after a record having `edl` bytes of encoded data, written at `pos`.
+func recordEnd(pos int64, edl int, blocksize int) int64 {
+	// A record's header is never split across blocks.
+	if rem := blocksize - int(pos%int64(blocksize)); rem < recordHeaderSize {
+		pos += int64(rem)
+	}
+	return pos + recordHeaderSize + int64(edl)
+}
+
+// CorruptionError is returned when a record read from a file is not the one that was written.
+type CorruptionError struct {
+	// The file (aka segment) that contains the record.
+	Segment string
+	// The position of the record (its header) in the file.
+	Offset int64
+	// What is wrong with the record.
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corrupted record in file '%s' at offset %d: %s", e.Segment, e.Offset, e.Reason)
+}
@@ -0,0 +1,132 @@
+package queue
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/devisions/go-playground/go-directio/internal/data"
+	"github.com/pkg/errors"
+)
+
+// Extension added to the name of a recycled file (aka segment): instead of being deleted by the retention,
+// it is kept for being reused by the Writer as a new file, saving the allocation of its blocks.
+const RECYCLED_EXT = ".free"
+
+// The locks of the recycled files of each path. They are shared by the writers and the cleaners of a process,
+// so that a file does not get recycled while the recycled ones are being counted or reused.
+var recycledLocks sync.Map
+
+// lockRecycled locks the recycled files of the path, returning the function that unlocks them.
+func lockRecycled(iopath string) func() {
+	l, _ := recycledLocks.LoadOrStore(path.Clean(iopath), &sync.Mutex{})
+	mu := l.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// getRecycledFileNames returns the names of the recycled files of the path, sorted by their base offset.
+func getRecycledFileNames(iopath string) ([]string, error) {
+	f, err := os.Open(iopath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	all, err := f.Readdirnames(0)
+	if err != nil {
+		return nil, err
+	}
+	fnames := make([]string, 0)
+	for _, fn := range all {
+		if RECYCLED_EXT == path.Ext(fn) && strings.HasSuffix(strings.TrimSuffix(fn, RECYCLED_EXT), ".dat") {
+			fnames = append(fnames, fn)
+		}
+	}
+	sort.Strings(fnames)
+	return fnames, nil
+}
+
+// recycleSegment deletes the indexes of the file (aka segment) and renames it as a recycled file.
+func recycleSegment(segmentFilepath string) error {
+	for _, fp := range []string{indexFilepath(segmentFilepath), timeIndexFilepath(segmentFilepath)} {
+		if err := data.DeleteFile(fp); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(segmentFilepath, segmentFilepath+RECYCLED_EXT)
+}
+
+// reuseRecycledFile turns one of the recycled files of the path (if any) into the new file at `filepath`, having `baseOffset`.
+// Its new header gets written and the rest of it cleared (see `clearRecycledFile`) before renaming it, so that it never shows up
+// with anything of its previous use: a Reader (or a restarted Writer) takes its blocks after the last record as not written yet.
+// It returns false if there is no recycled file, or if the one found is gone (ex: reused or deleted by another process).
+func reuseRecycledFile(path string, filepath string, baseOffset uint64, opts *fileOptions) (bool, error) {
+	defer lockRecycled(path)()
+	fnames, err := getRecycledFileNames(path)
+	if err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("looking for recycled files on path '%s'", path))
+	}
+	if len(fnames) == 0 {
+		return false, nil
+	}
+	from := path + string(os.PathSeparator) + fnames[0]
+	f, err := data.OpenExistingFileForWriting(from)
+	if os.IsNotExist(errors.Cause(err)) {
+		log.Printf("[WARN] The recycled file %s is gone, so a new file gets created instead.\n", from)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	err = writeSegmentHeader(f, opts.blocksize, baseOffset)
+	if err == nil {
+		err = clearRecycledFile(f, opts.blocksize)
+	}
+	if err == nil {
+		// It might be smaller, if it got sealed before being full.
+		err = opts.preallocateFile(f)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := os.Rename(from, filepath); err != nil {
+		if os.IsNotExist(err) {
+			log.Printf("[WARN] The recycled file %s is gone, so a new file gets created instead.\n", from)
+			return false, nil
+		}
+		return false, errors.Wrap(err, fmt.Sprintf("renaming the recycled file %s", from))
+	}
+	log.Println("Reusing the recycled file", from, "as", filepath)
+	return true, nil
+}
+
+// clearRecycledFile zeroes the blocks of the recycled file after its header, as the bytes left from its previous use
+// (ex: the middle of a record) might look like anything where a new record is expected. If the file system does not
+// support zeroing a range of a file, the file gets truncated instead (so preallocating it allocates its blocks again).
+func clearRecycledFile(f *os.File, blocksize int) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("getting the size of the recycled file %s", f.Name()))
+	}
+	if fi.Size() <= int64(blocksize) {
+		return nil
+	}
+	err = zeroRange(f, int64(blocksize), fi.Size()-int64(blocksize))
+	if err == errPreallocateUnsupported {
+		err = f.Truncate(int64(blocksize))
+	}
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("clearing the recycled file %s", f.Name()))
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package queue
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/devisions/go-playground/go-directio/codec"
+	"github.com/devisions/go-playground/go-directio/config"
+)
+
+// newRecycleTestConfig returns the config of a path whose files get recycled once consumed (see `recycleConsumed`).
+// Being small, the files hold a few records each.
+func newRecycleTestConfig(path string) *config.Config {
+	cfg := newTestConfig(path)
+	cfg.MaxFileSizeBytes = 8 * 4096
+	cfg.RecycleSegments = 4
+	cfg.RetentionDeleteConsumed = true
+	return cfg
+}
+
+// appendSizedValues appends the values of the offsets from the Writer's next one up to `until` (excluded), flushing
+// each one, so that the records end in different blocks. The value of offset `o` is `sizes[o%len(sizes)]` bytes long.
+func appendSizedValues(q *Queue[string], w *Writer, until uint64, sizes []int) error {
+	for o := w.NextOffset(); o < until; o++ {
+		if err := appendTestValues(q, w, o+1, sizes[o%uint64(len(sizes))]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recycleConsumed consumes the records of the path and then lets the retention recycle the files consumed
+// (all of them, except for the latest one), returning how many recycled files there are.
+func recycleConsumed(cfg *config.Config) (int, error) {
+	c, err := newConsumer(cfg)
+	if err != nil {
+		return 0, err
+	}
+	err = c.consumeAll()
+	c.close()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := NewCleaner(cfg).Clean(); err != nil {
+		return 0, err
+	}
+	fnames, err := getRecycledFileNames(cfg.Path)
+	return len(fnames), err
+}
+
+// TestRecycledFile appends to recycled files, whose records of their previous use end elsewhere than the new ones,
+// while a Reader tails them, polling again and again while there is nothing new to read. It then checks that a new
+// Writer continues after the last record of the recycled file being written, without taking its tail as a torn one.
+func TestRecycledFile(t *testing.T) {
+	cfg := newRecycleTestConfig(t.TempDir())
+	w, err := NewWriter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := NewQueue[string](w, nil, codec.JSON[string]{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := appendSizedValues(q, w, 20, []int{25_000, 5_000}); err != nil {
+		t.Fatal(err)
+	}
+	recycled, err := recycleConsumed(cfg)
+	if err != nil || recycled == 0 {
+		t.Fatalf("got %d recycled files (err: %v)", recycled, err)
+	}
+
+	c, err := newConsumer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	sizes := []int{12_000, 3_000, 7_000}
+	for o := w.NextOffset(); o < 50; o++ {
+		if err := appendSizedValues(q, w, o+1, sizes); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i <= MAX_REREADS; i++ {
+			if err := c.consumeAll(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if c.next != o+1 {
+			t.Fatalf("got %d records, instead of %d", c.next, o+1)
+		}
+	}
+	if left, err := getRecycledFileNames(cfg.Path); err != nil || len(left) >= recycled {
+		t.Fatalf("%d of the %d recycled files are left (err: %v)", len(left), recycled, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	out := log.Writer()
+	log.SetOutput(&logs)
+	w, err = NewWriter(cfg)
+	log.SetOutput(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = w.Close() }()
+	if strings.Contains(logs.String(), "[WARN]") {
+		t.Fatalf("the new Writer warned:\n%s", logs.String())
+	}
+	if w.NextOffset() != 50 {
+		t.Fatalf("the new Writer continues from offset %d, instead of 50", w.NextOffset())
+	}
+	if q, err = NewQueue[string](w, nil, codec.JSON[string]{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendSizedValues(q, w, 60, sizes); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.consumeAll(); err != nil {
+		t.Fatal(err)
+	}
+	if c.next != 60 {
+		t.Fatalf("got %d records, instead of 60", c.next)
+	}
+}
@@ -0,0 +1,214 @@
+package queue
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/devisions/go-playground/go-directio/config"
+	"github.com/pkg/errors"
+)
+
+// RetentionPolicy tells which files (aka segments) get deleted by a Cleaner.
+// A zero limit means there is no such limit.
+type RetentionPolicy struct {
+	// Files last written longer than this ago get deleted.
+	MaxAge time.Duration
+	// The oldest files get deleted while the total size of the files exceeds this.
+	MaxBytes int64
+	// The oldest files get deleted while there are more files than this.
+	MaxSegments int
+	// Files whose records were consumed by all the consumers (according to their saved states) get deleted.
+	DeleteConsumed bool
+}
+
+// Cleaner deletes the files (aka segments) of a path, along with their indexes, according to a retention policy.
+// Only the sealed files get deleted, the oldest first, so that the remaining records are contiguous.
+// In archive mode, the files are moved into the archive path instead, where they are kept according to their own retention policy.
+// Otherwise, the files consumed by all the consumers can be recycled instead of being deleted (see `RECYCLED_EXT`).
+type Cleaner struct {
+	path      string
+	blocksize int
+	policy    RetentionPolicy
+
+	// If not empty, the files removed from `path` get moved into it.
+	archivePath string
+	// Whether the archived files get compressed.
+	archiveCompress bool
+	archivePolicy   RetentionPolicy
+
+	// How many recycled files are kept for being reused by the Writer.
+	recycleSegments int
+}
+
+// NewCleaner creates a Cleaner of the files in the configured path, using the configured retention policy.
+// The files are used with the I/O mode selected by a Writer (or Reader) of the same path (see `data.UseBufferedIO`),
+// so it must be created after them, as they also set the block size, if it is 0 (see `ResolveBlockSize`).
+func NewCleaner(cfg *config.Config) *Cleaner {
+	return &Cleaner{
+		path:      cfg.Path,
+		blocksize: cfg.BlockSize,
+		policy: RetentionPolicy{
+			MaxAge:         cfg.RetentionMaxAge,
+			MaxBytes:       cfg.RetentionMaxBytes,
+			MaxSegments:    cfg.RetentionMaxSegments,
+			DeleteConsumed: cfg.RetentionDeleteConsumed,
+		},
+		archivePath:     cfg.ArchivePath,
+		archiveCompress: cfg.ArchiveCompress,
+		archivePolicy: RetentionPolicy{
+			MaxAge:      cfg.ArchiveMaxAge,
+			MaxBytes:    cfg.ArchiveMaxBytes,
+			MaxSegments: cfg.ArchiveMaxSegments,
+		},
+		recycleSegments: cfg.RecycleSegments,
+	}
+}
+
+// Policy returns the retention policy in use.
+func (c *Cleaner) Policy() RetentionPolicy {
+	return c.policy
+}
+
+// ArchivePolicy returns the retention policy of the archived files.
+func (c *Cleaner) ArchivePolicy() RetentionPolicy {
+	return c.archivePolicy
+}
+
+// segmentFile describes a file (aka segment) considered by the Cleaner.
+type segmentFile struct {
+	filepath   string
+	baseOffset uint64
+	size       int64
+	modTime    time.Time
+}
+
+// Clean deletes (or archives) the files that are beyond the retention, returning how many got removed from the path.
+// In archive mode, it also deletes the archived files that are beyond their retention.
+func (c *Cleaner) Clean() (int, error) {
+	removed, err := c.clean(c.path, c.policy, true, c.remove)
+	if err != nil || c.archivePath == "" {
+		return removed, err
+	}
+	_, err = c.clean(c.archivePath, c.archivePolicy, false, deleteSegment)
+	return removed, err
+}
+
+// clean removes, using `remove`, the oldest files of `dir` while any of the `policy` limits is exceeded.
+// If `keepLatest` is true, the latest file is never removed, being the one (to be) written into.
+func (c *Cleaner) clean(dir string, policy RetentionPolicy, keepLatest bool, remove func(filepath string, reason string) error) (int, error) {
+	fnames, err := getSegmentFileNames(dir)
+	if err != nil {
+		if os.IsNotExist(err) && dir == c.archivePath {
+			return 0, nil // Nothing got archived yet.
+		}
+		return 0, errors.Wrap(err, fmt.Sprintf("looking for files on path '%s'", dir))
+	}
+	files := make([]segmentFile, 0, len(fnames))
+	var total int64
+	for _, fn := range fnames {
+		fp := dir + string(os.PathSeparator) + fn
+		fi, err := os.Stat(fp)
+		if err != nil {
+			return 0, errors.Wrap(err, "trying to get the file info")
+		}
+		base, _ := getBaseOffsetOfFilename(fn)
+		files = append(files, segmentFile{filepath: fp, baseOffset: base, size: fi.Size(), modTime: fi.ModTime()})
+		total += fi.Size()
+	}
+
+	// Files get recycled, instead of being deleted, only if consumed by all the consumers, so that none is reading them anymore.
+	recycle := dir == c.path && c.archivePath == "" && c.recycleSegments > 0
+
+	// The records before this offset were consumed by all the consumers.
+	var consumed uint64
+	if policy.DeleteConsumed || recycle {
+		states, err := loadConsumerStates(c.path, c.blocksize)
+		if err != nil {
+			return 0, errors.Wrap(err, "loading the states of the consumers")
+		}
+		first := true
+		for _, s := range states {
+			if first || s.NextOffset < consumed {
+				consumed = s.NextOffset
+				first = false
+			}
+		}
+	}
+
+	removed := 0
+	count := len(files)
+	last := len(files)
+	if keepLatest {
+		last--
+	}
+	for i := 0; i < last; i++ {
+		f := files[i]
+		var reason string
+		switch {
+		case policy.MaxSegments > 0 && count > policy.MaxSegments:
+			reason = "max segments"
+		case policy.MaxBytes > 0 && total > policy.MaxBytes:
+			reason = "max bytes"
+		case policy.MaxAge > 0 && time.Since(f.modTime) > policy.MaxAge:
+			reason = "max age"
+		case policy.DeleteConsumed && consumed > 0 && i+1 < len(files) && files[i+1].baseOffset <= consumed:
+			reason = "consumed"
+		}
+		if reason == "" {
+			break
+		}
+		if recycle && consumed > 0 && i+1 < len(files) && files[i+1].baseOffset <= consumed {
+			err = c.recycle(f.filepath, reason)
+		} else {
+			err = remove(f.filepath, reason)
+		}
+		if err != nil {
+			return removed, err
+		}
+		count--
+		total -= f.size
+		removed++
+	}
+	return removed, nil
+}
+
+// remove deletes the file (aka segment) or, in archive mode, moves it into the archive path.
+func (c *Cleaner) remove(filepath string, reason string) error {
+	if c.archivePath == "" {
+		return deleteSegment(filepath, reason)
+	}
+	to, err := archiveSegment(filepath, c.archivePath, c.archiveCompress)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("archiving file %s", filepath))
+	}
+	log.Printf("Archived file %s as %s (%s)\n", filepath, to, reason)
+	return nil
+}
+
+// recycle renames the file (aka segment) as a recycled one, unless there are enough recycled files already,
+// in which case it gets deleted.
+func (c *Cleaner) recycle(filepath string, reason string) error {
+	defer lockRecycled(c.path)()
+	fnames, err := getRecycledFileNames(c.path)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("looking for recycled files on path '%s'", c.path))
+	}
+	if len(fnames) >= c.recycleSegments {
+		return deleteSegment(filepath, reason)
+	}
+	if err := recycleSegment(filepath); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("recycling file %s", filepath))
+	}
+	log.Printf("Recycled file %s (%s)\n", filepath, reason)
+	return nil
+}
+
+func deleteSegment(filepath string, reason string) error {
+	if err := DeleteSegment(filepath); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, fmt.Sprintf("deleting file %s", filepath))
+	}
+	log.Printf("Deleted file %s (%s)\n", filepath, reason)
+	return nil
+}
@@ -0,0 +1,164 @@
+package queue
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/devisions/go-playground/go-directio/internal/data"
+	"github.com/ncw/directio"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Magic number that every file (aka segment) starts with ("DIOQ").
+	segmentMagic = 0x51_4f_49_44
+
+	// Version of the format used for writing the segments.
+	segmentFormatVersion = 8
+
+	// Size of the (used part of the) segment header.
+	segmentHeaderSize = 32
+)
+
+// segmentHeader is stored in the first block of each segment.
+type segmentHeader struct {
+	// Version of the format the segment was written with.
+	Version uint32
+	// Size of the blocks the segment was written with.
+	BlockSize int
+	// Offset of the first record of the segment in the whole log.
+	// The segment's file is named after it.
+	BaseOffset uint64
+	// When the segment was created.
+	CreatedAt time.Time
+}
+
+func newSegmentHeader(blocksize int, baseOffset uint64) *segmentHeader {
+	return &segmentHeader{
+		Version:    segmentFormatVersion,
+		BlockSize:  blocksize,
+		BaseOffset: baseOffset,
+		CreatedAt:  time.Now().UTC(),
+	}
+}
+
+// encodeTo puts the header at the beginning of `block`, followed by zeros.
+func (h *segmentHeader) encodeTo(block []byte) {
+	for i := range block {
+		block[i] = 0
+	}
+	copy(block[0:4], data.I32toBytes(segmentMagic))
+	copy(block[4:8], data.I32toBytes(h.Version))
+	copy(block[8:12], data.I32toBytes(uint32(h.BlockSize)))
+	copy(block[12:20], data.I64toBytes(h.BaseOffset))
+	copy(block[20:28], data.I64toBytes(uint64(h.CreatedAt.UnixNano())))
+	copy(block[28:32], data.I32toBytes(crc32cOf(block[:28])))
+}
+
+// decodeSegmentHeader gets the header from the beginning of `block`, checking its integrity.
+func decodeSegmentHeader(block []byte) (*segmentHeader, error) {
+	if len(block) < segmentHeaderSize || data.BytesToI32(block[0:4]) != segmentMagic {
+		return nil, errors.New("it does not start with a segment header")
+	}
+	if data.BytesToI32(block[28:32]) != crc32cOf(block[:28]) {
+		return nil, errors.New("its segment header is corrupted")
+	}
+	return &segmentHeader{
+		Version:    data.BytesToI32(block[4:8]),
+		BlockSize:  int(data.BytesToI32(block[8:12])),
+		BaseOffset: data.BytesToI64(block[12:20]),
+		CreatedAt:  time.Unix(0, int64(data.BytesToI64(block[20:28]))).UTC(),
+	}, nil
+}
+
+// validate checks that a segment having this header can be written and read using `blocksize` blocks.
+func (h *segmentHeader) validate(blocksize int) error {
+	if h.Version != segmentFormatVersion {
+		return errors.New(fmt.Sprintf("it was written with format version %d, while version %d is used", h.Version, segmentFormatVersion))
+	}
+	if h.BlockSize != blocksize {
+		return errors.New(fmt.Sprintf("it was written with a %d bytes block, while a %d bytes block is used", h.BlockSize, blocksize))
+	}
+	return nil
+}
+
+// writeSegmentHeader writes a new header block into `f`, an empty segment.
+func writeSegmentHeader(f *os.File, blocksize int, baseOffset uint64) error {
+	block := directio.AlignedBlock(blocksize)
+	newSegmentHeader(blocksize, baseOffset).encodeTo(block)
+	if _, err := f.Write(block); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("writing the header of file %s", f.Name()))
+	}
+	return nil
+}
+
+// writeEndOfSegment writes, into a new block of `f`, the record that marks the end of the segment.
+// The `nextOffset` is the offset of the first record of the next segment.
+func writeEndOfSegment(f *os.File, blocksize int, nextOffset uint64) error {
+	block := directio.AlignedBlock(blocksize)
+	putRecordHeader(block, recordHeader{kind: recordKindEnd, offset: nextOffset}, nil)
+	if _, err := f.Write(block); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("writing the end of file %s", f.Name()))
+	}
+	return nil
+}
+
+// readSegmentHeader reads and validates the header block of segment `f`, read through `in`.
+// The file is expected to be at its beginning and it is left right after the header.
+// It returns `io.EOF` if the header was not (completely) written yet.
+func readSegmentHeader(f *os.File, in io.Reader, blocksize int) (*segmentHeader, error) {
+	block := directio.AlignedBlock(blocksize)
+	if _, err := io.ReadFull(in, block); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		}
+		return nil, errors.Wrap(err, fmt.Sprintf("reading the header of file %s", f.Name()))
+	}
+	h, err := decodeSegmentHeader(block)
+	if err == nil {
+		err = h.validate(blocksize)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("refusing to use file %s", f.Name()))
+	}
+	return h, nil
+}
+
+// openSegmentForReading opens the segment and validates its header. It returns the file and the reader
+// to read the blocks through: the file itself or, for a compressed (archived) segment, its decompressor.
+// On success, the returned reader is positioned right after the header block.
+func openSegmentForReading(filepath string, blocksize int) (*os.File, io.Reader, *segmentHeader, error) {
+	var f *os.File
+	var in io.Reader
+	var err error
+	if strings.HasSuffix(filepath, COMPRESSED_EXT) {
+		if f, err = os.Open(filepath); err != nil {
+			return nil, nil, nil, errors.Wrap(err, fmt.Sprintf("while opening file %s for reading", filepath))
+		}
+		if in, err = gzip.NewReader(f); err != nil {
+			_ = f.Close()
+			return nil, nil, nil, errors.Wrap(err, fmt.Sprintf("decompressing file %s", filepath))
+		}
+	} else {
+		if f, err = data.OpenFileForReading(filepath); err != nil {
+			return nil, nil, nil, err
+		}
+		in = f
+	}
+	h, err := readSegmentHeader(f, in, blocksize)
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, nil, err
+	}
+	return f, in, h, nil
+}
+
+// segmentFileName returns the name of the segment's file having `baseOffset`.
+// The offset is zero padded, so that sorting the names sorts the segments.
+func segmentFileName(baseOffset uint64) string {
+	return fmt.Sprintf("%020d.dat", baseOffset)
+}
@@ -0,0 +1,373 @@
+package queue
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/devisions/go-playground/go-directio/internal/data"
+	"github.com/devisions/go-playground/go-directio/ioengine"
+	"github.com/ncw/directio"
+	"github.com/pkg/errors"
+)
+
+// segmentReader reads the records of a segment, block by block. Unless the segment is compressed,
+// it reads several blocks at once (as many as the blocks it is given) and then uses them one by one.
+type segmentReader struct {
+	// The segment file.
+	f *os.File
+
+	// Where the blocks are read from: the file itself or, if it is compressed, its decompressor.
+	in io.Reader
+
+	// Reads the blocks from the file, at their positions, unless it is compressed.
+	engine ioengine.Engine
+
+	// The blocks (re)used for reading, in a single read of an I/O vector per block.
+	blocks [][]byte
+
+	// If not nil, counts the reads of the blocks.
+	stats *IOStats
+
+	// Blocks of `blocks` that the last read filled: the current one and the ones read ahead.
+	filled int
+
+	// The current block: the one of `blocks` having index `cur`.
+	block []byte
+	cur   int
+
+	// Size of the `block`.
+	blocksize int
+
+	// Read bytes from the file, up to the end of the current block. It is always a multiple of `blocksize`.
+	readBytes int64
+
+	// Position in the `block` of the next byte to read.
+	pos int
+
+	// Bytes to skip from the next block read, when starting in the middle of it.
+	skip int
+
+	// Offset of the first record of the segment, as stored in its header.
+	base uint64
+
+	// Offset that the next record must have.
+	expected uint64
+
+	// The record being read, if its encoded data continues in blocks not yet written.
+	pending *record
+}
+
+// record is a record read from a segment.
+type record struct {
+	recordHeader
+	header []byte
+	// The encoded data.
+	ed []byte
+	// Bytes of `ed` read so far.
+	read int
+	// The position of the record (its header) in the segment.
+	pos int64
+}
+
+// openSegmentReader opens the segment (validating its header) for reading its records, into the (aligned) blocks,
+// using the I/O engine. It returns `io.EOF` if the segment's header is not written yet.
+func openSegmentReader(filepath string, blocks [][]byte, engine ioengine.Engine) (*segmentReader, error) {
+	blocksize := len(blocks[0])
+	f, in, h, err := openSegmentForReading(filepath, blocksize)
+	if err != nil {
+		return nil, err
+	}
+	sr := segmentReader{
+		f:         f,
+		in:        in,
+		engine:    engine,
+		blocks:    blocks,
+		block:     blocks[0],
+		blocksize: blocksize,
+		readBytes: int64(blocksize), // the header block was already read
+		pos:       blocksize,        // no block of records was read yet
+		base:      h.BaseOffset,
+		expected:  h.BaseOffset,
+	}
+	return &sr, nil
+}
+
+func (sr *segmentReader) name() string {
+	return sr.f.Name()
+}
+
+// close closes the segment. In buffered I/O mode, its pages get dropped from the page cache before.
+func (sr *segmentReader) close() error {
+	if !sr.compressed() && data.IOModeOf(sr.name()) == data.IO_MODE_BUFFERED {
+		_ = data.DropPageCache(sr.f)
+	}
+	return sr.f.Close()
+}
+
+// compressed tells if the segment is a compressed (archived) one.
+func (sr *segmentReader) compressed() bool {
+	return sr.in != io.Reader(sr.f)
+}
+
+// position returns the position in the segment of the next byte to read.
+func (sr *segmentReader) position() int64 {
+	return sr.readBytes - int64(sr.blocksize-sr.pos) + int64(sr.skip)
+}
+
+// seek moves to the record that the index entry points to, skipping the records before it.
+// It must be used before reading any record. A compressed segment cannot be seeked,
+// so it is read from its beginning.
+func (sr *segmentReader) seek(e indexEntry) {
+	if sr.compressed() {
+		return
+	}
+	sr.readBytes = e.block
+	sr.skip = e.inBlock
+	sr.expected = e.offset
+	sr.filled = 0
+}
+
+// next reads the next record, skipping the padding.
+// It returns `io.EOF` if the next record is not (completely) written yet: the file ends before it (or before its end)
+// or nothing (zeros) is written where it should start or continue (ex: a preallocated or a recycled segment,
+// see `clearRecycledFile`). In the last two cases, the record stays pending, to be read again by the next call.
+// The bytes after the last record of a segment being written might be anything, so a `CorruptionError`
+// is a real one only if the segment is completely written.
+func (sr *segmentReader) next() (*record, error) {
+	// First, let's find the header of the next record, if not already found.
+	for sr.pending == nil {
+		// A record's header is never split across blocks, so the tail of a block might not contain one.
+		if sr.pos+recordHeaderSize > sr.blocksize {
+			if err := sr.nextBlock(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		header := sr.block[sr.pos : sr.pos+recordHeaderSize]
+		h := decodeRecordHeader(header)
+		if h.kind == recordKindNone {
+			sr.rewind(sr.position())
+			return nil, io.EOF
+		}
+		edl := recordLength(header)
+		if h.kind != recordKindData && h.kind != recordKindEnd && h.kind != recordKindPadding && !isMarker(h.kind) {
+			return nil, &CorruptionError{Segment: sr.name(), Offset: sr.position(), Reason: fmt.Sprintf("unknown kind %d", h.kind)}
+		}
+		if edl > MAX_EDL {
+			return nil, &CorruptionError{Segment: sr.name(), Offset: sr.position(), Reason: fmt.Sprintf("encoded data length %d exceeds the maximum", edl)}
+		}
+		// The offsets of the records (transaction markers included) must be consecutive.
+		// The end record and the padding have the offset of the next record.
+		if h.offset != sr.expected {
+			return nil, &CorruptionError{Segment: sr.name(), Offset: sr.position(), Reason: fmt.Sprintf("offset %d instead of %d", h.offset, sr.expected)}
+		}
+		if h.kind == recordKindPadding {
+			if edl != 0 || !verifyRecord(header, nil) {
+				return nil, &CorruptionError{Segment: sr.name(), Offset: sr.position(), Reason: "invalid padding"}
+			}
+			// The rest of the block is padding.
+			sr.pos = sr.blocksize
+			continue
+		}
+		sr.pending = &record{
+			recordHeader: h,
+			header:       append([]byte(nil), header...),
+			ed:           make([]byte, edl),
+			pos:          sr.position(),
+		}
+		sr.pos += recordHeaderSize
+	}
+
+	// The encoded data might continue in the next block(s) that may not be written yet.
+	rec := sr.pending
+	for rec.read < len(rec.ed) {
+		if sr.pos == sr.blocksize {
+			if err := sr.nextBlock(); err != nil {
+				return nil, err
+			}
+		}
+		n := copy(rec.ed[rec.read:], sr.block[sr.pos:])
+		rec.read += n
+		sr.pos += n
+	}
+	sr.pending = nil
+
+	if !verifyRecord(rec.header, rec.ed) {
+		if sr.unwritten(rec) {
+			return nil, io.EOF
+		}
+		return nil, &CorruptionError{Segment: sr.name(), Offset: rec.pos, Reason: "checksum mismatch"}
+	}
+	if rec.kind != recordKindEnd {
+		sr.expected++
+	}
+	return rec, nil
+}
+
+// unwritten looks for the first block of the record, after the one holding its header, whose bytes are all zeros:
+// the blocks are written in order, so that one and the ones after it are not written yet (ex: they are still in the
+// Writer's buffer). If found, the record becomes pending again, so that the next call reads it again from that block.
+// A compressed segment is complete, so its blocks are all written.
+func (sr *segmentReader) unwritten(rec *record) bool {
+	if sr.compressed() {
+		return false
+	}
+	bs := int64(sr.blocksize)
+	start := rec.pos + recordHeaderSize // The position of the encoded data.
+	for b := rec.pos - rec.pos%bs + bs; b < start+int64(len(rec.ed)); b += bs {
+		from, to := b-start, b-start+bs
+		if to > int64(len(rec.ed)) {
+			to = int64(len(rec.ed))
+		}
+		if zeros(rec.ed[from:to]) {
+			rec.read = int(from)
+			sr.pending = rec
+			sr.readBytes = b
+			sr.pos = sr.blocksize
+			sr.filled = 0
+			return true
+		}
+	}
+	return false
+}
+
+// zeros tells if all the bytes of `b` are zeros.
+func zeros(b []byte) bool {
+	for _, x := range b {
+		if x != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// nextBlock moves to the next block: the next one read ahead, if any, or the first one of the blocks read from
+// the file. It returns `io.EOF` if that block is not (completely) written yet, in which case it gets read again
+// (from the same position) by the next call.
+func (sr *segmentReader) nextBlock() error {
+	switch {
+	case sr.compressed():
+		if _, err := io.ReadFull(sr.in, sr.block); err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				return errors.Wrap(err, "reading from file")
+			}
+			return io.EOF
+		}
+	case sr.cur+1 < sr.filled:
+		sr.cur++
+		sr.block = sr.blocks[sr.cur]
+	default:
+		n, err := sr.engine.ReadAt(sr.f, sr.blocks, sr.readBytes)
+		if err != nil {
+			sr.filled = 0
+			return errors.Wrap(err, "reading from file")
+		}
+		if sr.stats != nil {
+			sr.stats.add(sr.name(), n)
+		}
+		// The file might end in the middle of a block, that is not completely written yet.
+		if sr.filled = n / sr.blocksize; sr.filled == 0 {
+			return io.EOF
+		}
+		sr.cur = 0
+		sr.block = sr.blocks[0]
+	}
+	sr.readBytes += int64(sr.blocksize)
+	sr.pos = sr.skip
+	sr.skip = 0
+	return nil
+}
+
+// rewind moves back to position `pos` (of a record's header), so that the blocks from there get read again
+// (the ones read ahead included), as they were not (completely) written when read.
+// A compressed segment is complete, so it is not rewound.
+func (sr *segmentReader) rewind(pos int64) {
+	if sr.compressed() {
+		return
+	}
+	start := pos - pos%int64(sr.blocksize)
+	sr.readBytes = start
+	sr.skip = int(pos - start)
+	sr.pos = sr.blocksize
+	sr.pending = nil
+	sr.filled = 0
+}
+
+// segmentInfo describes the records found in a segment.
+type segmentInfo struct {
+	// Offset of the first record, as stored in the header.
+	baseOffset uint64
+	// Offset of the record that follows the last one.
+	nextOffset uint64
+	// Number of data records.
+	records int
+	// Position right after the last record.
+	end int64
+	// Whether the segment ends with an end of segment record.
+	sealed bool
+	// Whether the last record is incomplete: its encoded data continues in blocks not written (yet).
+	incomplete bool
+	// Whether the last record (data or transaction marker) is part of a transaction that is not committed nor aborted (yet).
+	openTxn bool
+	// The indexes of the segment, as they should be.
+	index *indexBuilder
+}
+
+// size returns the size of the segment up to the end of the block containing its last record:
+// where the next block gets written.
+func (info *segmentInfo) size(blocksize int) int64 {
+	size := info.end
+	if rem := size % int64(blocksize); rem > 0 {
+		size += int64(blocksize) - rem
+	}
+	return size
+}
+
+// newSegmentInfo returns the info of a segment having `baseOffset`, with no records.
+func newSegmentInfo(baseOffset uint64, blocksize int) *segmentInfo {
+	return &segmentInfo{
+		baseOffset: baseOffset,
+		nextOffset: baseOffset,
+		end:        int64(blocksize),
+		index:      &indexBuilder{baseOffset: baseOffset, blocksize: blocksize},
+	}
+}
+
+// scanSegment reads all the records of the segment, building its indexes along the way.
+// It returns `io.EOF` if the segment's header is not written yet. On a `CorruptionError`,
+// it returns the info about the records before the corrupted one as well.
+func scanSegment(filepath string, blocksize int) (*segmentInfo, error) {
+	sr, err := openSegmentReader(filepath, [][]byte{directio.AlignedBlock(blocksize)}, ioengine.Sync{})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = sr.close() }()
+	info := newSegmentInfo(sr.base, blocksize)
+	for {
+		rec, err := sr.next()
+		if err == io.EOF {
+			info.incomplete = sr.pending != nil
+			return info, nil
+		}
+		if _, ok := err.(*CorruptionError); ok {
+			return info, err
+		}
+		if err != nil {
+			return nil, err
+		}
+		info.end = sr.position()
+		info.nextOffset = sr.expected
+		if rec.kind == recordKindEnd {
+			info.sealed = true
+			return info, nil
+		}
+		if isMarker(rec.kind) {
+			info.openTxn = rec.kind == recordKindBegin
+			continue
+		}
+		info.openTxn = rec.flags&recordFlagTransactional != 0
+		info.index.add(rec.offset, rec.pos, envelopeTimestamp(rec.ed))
+		info.records++
+	}
+}
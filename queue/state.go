@@ -0,0 +1,180 @@
+package queue
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/devisions/go-playground/go-directio/internal/data"
+	"github.com/ncw/directio"
+	"github.com/pkg/errors"
+)
+
+// Extension of the files that the consumers save their states into, as {consumer name}.state.
+const STATE_FILE_EXT = ".state"
+
+// Extension of the temporary file that a state is written into, before replacing the saved one.
+const stateTmpExt = ".tmp"
+
+// Size of the header of a saved state: checksum (CRC32C) 4, generation 8, length of the encoded state 4.
+const stateHeaderSize = 16
+
+// ConsumerState is the position of a consumer: the offset of the next record to read.
+type ConsumerState struct {
+	NextOffset         uint64
+	saveStateFilepath  string
+	saveStateBlocksize int
+	// Incremented on each save, so that the newest of the saved copies can be told.
+	generation uint64
+}
+
+// encode puts the header and then the encoded state into `to`, followed by zeros.
+func (s *ConsumerState) encode(to []byte) error {
+	buf := bytes.Buffer{}
+	_ = gob.NewEncoder(&buf).Encode(*s)
+	if len(to) < stateHeaderSize+buf.Len() {
+		return errors.New("cannot copy encoded into a smaller buffer")
+	}
+	for i := range to {
+		to[i] = 0
+	}
+	copy(to[4:12], data.I64toBytes(s.generation))
+	copy(to[12:16], data.I32toBytes(uint32(buf.Len())))
+	copy(to[stateHeaderSize:], buf.Bytes())
+	copy(to[0:4], data.I32toBytes(crc32cOf(to[4:stateHeaderSize+buf.Len()])))
+	return nil
+}
+
+// decodeState gets the state from `from`, checking its integrity.
+func decodeState(from []byte) (*ConsumerState, error) {
+	if len(from) < stateHeaderSize {
+		return nil, errors.New("it is too short")
+	}
+	l := int(data.BytesToI32(from[12:16]))
+	if l > len(from)-stateHeaderSize || data.BytesToI32(from[0:4]) != crc32cOf(from[4:stateHeaderSize+l]) {
+		return nil, errors.New("checksum mismatch")
+	}
+	s := &ConsumerState{}
+	dec := gob.NewDecoder(bytes.NewReader(from[stateHeaderSize : stateHeaderSize+l]))
+	err := dec.Decode(s)
+	if err != nil && err != io.EOF {
+		return nil, errors.Wrap(err, "decoding data")
+	}
+	s.generation = data.BytesToI64(from[4:12])
+	return s, nil
+}
+
+// SaveToFile saves the state atomically: it is written and synced into a temporary file,
+// that then replaces the previous state file, followed by syncing the directory.
+// A crash leaves either the previous state or the new one (plus, maybe, the temporary file).
+func (s *ConsumerState) SaveToFile() error {
+	tmp := s.saveStateFilepath + stateTmpExt
+	f, err := data.OpenFileForWriting(tmp, false, os.O_TRUNC)
+	if err != nil {
+		return errors.Wrap(err, "opening file for writing the state")
+	}
+	s.generation++
+	block := directio.AlignedBlock(s.saveStateBlocksize)
+	if err = s.encode(block); err != nil {
+		_ = f.Close()
+		return errors.Wrap(err, "encoding state")
+	}
+	if _, err = f.Write(block); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("writing the state to file %s", tmp))
+	}
+	if err := os.Rename(tmp, s.saveStateFilepath); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("renaming file %s", tmp))
+	}
+	return syncDir(path.Dir(s.saveStateFilepath))
+}
+
+func initConsumerState(path string, name string, saveBlocksize int) (*ConsumerState, error) {
+	filepath := path + string(os.PathSeparator) + name + STATE_FILE_EXT
+	s, err := loadConsumerState(filepath, saveBlocksize)
+	if err != nil && os.IsNotExist(errors.Cause(err)) {
+		// There is no state file. We'll return an empty object.
+		// The file will eventually be created first time the state is saved.
+		return &ConsumerState{
+			saveStateFilepath:  filepath,
+			saveStateBlocksize: saveBlocksize,
+		}, nil
+	}
+	return s, err
+}
+
+// loadConsumerState reads the state saved in the file or, if newer and valid, the one left
+// in the temporary file by a save that was interrupted before replacing the file.
+// It returns an error that satisfies `os.IsNotExist` if none of them exist.
+func loadConsumerState(filepath string, saveBlocksize int) (*ConsumerState, error) {
+	s, err := readStateFile(filepath, saveBlocksize)
+	tmpState, tmpErr := readStateFile(filepath+stateTmpExt, saveBlocksize)
+	if tmpErr == nil && (err != nil || tmpState.generation > s.generation) {
+		log.Printf("[WARN] Using the state saved in file %s (generation %d), as an interrupted save left it.\n", filepath+stateTmpExt, tmpState.generation)
+		s, err = tmpState, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Being private, these are not encoded. So let's add them.
+	s.saveStateFilepath = filepath
+	s.saveStateBlocksize = saveBlocksize
+	return s, nil
+}
+
+// readStateFile reads and checks the state saved in the file.
+func readStateFile(filepath string, saveBlocksize int) (*ConsumerState, error) {
+	f, err := data.OpenFileForReading(filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	block := directio.AlignedBlock(saveBlocksize)
+	if _, err = io.ReadFull(f, block); err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, errors.Wrap(err, fmt.Sprintf("reading the state from file %s", filepath))
+	}
+	s, err := decodeState(block)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("using the state saved in file %s", filepath))
+	}
+	return s, nil
+}
+
+// loadConsumerStates reads the states saved by all the consumers of the path, by the consumer names.
+func loadConsumerStates(iopath string, saveBlocksize int) (map[string]*ConsumerState, error) {
+	f, err := os.Open(iopath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	fnames, err := f.Readdirnames(0)
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string]*ConsumerState)
+	for _, fn := range fnames {
+		if STATE_FILE_EXT != path.Ext(fn) {
+			continue
+		}
+		s, err := loadConsumerState(iopath+string(os.PathSeparator)+fn, saveBlocksize)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("loading the state from file %s", fn))
+		}
+		states[strings.TrimSuffix(fn, STATE_FILE_EXT)] = s
+	}
+	return states, nil
+}
+
+func (s *ConsumerState) IsEmpty() bool {
+	return s.NextOffset == 0
+}
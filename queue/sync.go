@@ -0,0 +1,113 @@
+package queue
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/devisions/go-playground/go-directio/config"
+	"github.com/pkg/errors"
+)
+
+// Modes of syncing the written data to the storage device.
+// O_DIRECT bypasses the page cache, but it does not guarantee that the drive's cache
+// or the file's metadata (ex: its size, after appending) are durable.
+const (
+	// Never sync. The data is durable only when the operating system decides so.
+	SYNC_NONE = "none"
+	// Write the pending block and fsync after each record.
+	SYNC_ALWAYS = "always"
+	// Write the pending block and fsync after every N records.
+	SYNC_RECORDS = "records"
+	// Write the pending block and fsync after every N bytes of records.
+	SYNC_BYTES = "bytes"
+	// Write the pending block and fsync when the interval since the last sync passed, on appending or flushing.
+	SYNC_INTERVAL = "interval"
+	// Open the files using O_DSYNC, so that each write of a block is synced.
+	SYNC_DSYNC = "dsync"
+)
+
+// SyncPolicy tells when the Writer syncs the written data to the storage device.
+// Regardless of the mode (except SYNC_NONE), a file gets synced before being sealed or closed.
+type SyncPolicy struct {
+	Mode         string
+	EveryRecords int
+	EveryBytes   int64
+	Interval     time.Duration
+}
+
+func newSyncPolicy(cfg *config.Config) (SyncPolicy, error) {
+	p := SyncPolicy{
+		Mode:         cfg.SyncMode,
+		EveryRecords: cfg.SyncEveryRecords,
+		EveryBytes:   cfg.SyncEveryBytes,
+		Interval:     cfg.SyncInterval,
+	}
+	switch {
+	case p.Mode == SYNC_RECORDS && p.EveryRecords <= 0:
+		return p, errors.New("the number of records between syncs must be positive")
+	case p.Mode == SYNC_BYTES && p.EveryBytes <= 0:
+		return p, errors.New("the number of bytes between syncs must be positive")
+	case p.Mode == SYNC_INTERVAL && p.Interval <= 0:
+		return p, errors.New("the interval between syncs must be positive")
+	case p.Mode != SYNC_NONE && p.Mode != SYNC_ALWAYS && p.Mode != SYNC_RECORDS &&
+		p.Mode != SYNC_BYTES && p.Mode != SYNC_INTERVAL && p.Mode != SYNC_DSYNC:
+		return p, errors.New(fmt.Sprintf("unknown sync mode '%s'", p.Mode))
+	}
+	return p, nil
+}
+
+// openFlags returns the flags to be added when opening a file for writing.
+func (p SyncPolicy) openFlags() int {
+	if p.Mode == SYNC_DSYNC {
+		return dsyncFlag
+	}
+	return 0
+}
+
+// SyncStats describes the latency of the syncs done by a Writer.
+// In SYNC_DSYNC mode, each write (of one or more blocks) counts as a sync.
+type SyncStats struct {
+	Count int64
+	Total time.Duration
+	Min   time.Duration
+	Max   time.Duration
+	Last  time.Duration
+}
+
+func (s *SyncStats) add(d time.Duration) {
+	if s.Count == 0 || d < s.Min {
+		s.Min = d
+	}
+	if d > s.Max {
+		s.Max = d
+	}
+	s.Count++
+	s.Total += d
+	s.Last = d
+}
+
+// Mean returns the average latency of a sync.
+func (s SyncStats) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Count)
+}
+
+func (s SyncStats) String() string {
+	return fmt.Sprintf("count: %d  mean: %s  min: %s  max: %s  last: %s", s.Count, s.Mean(), s.Min, s.Max, s.Last)
+}
+
+// syncDir syncs the directory, so that the files created in it are durable.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = d.Close() }()
+	if err := d.Sync(); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("syncing the directory %s", path))
+	}
+	return nil
+}
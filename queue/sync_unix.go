@@ -0,0 +1,8 @@
+//go:build !windows
+
+package queue
+
+import "syscall"
+
+// dsyncFlag makes each write to the file synced (its data and the metadata needed to read it back).
+const dsyncFlag = syscall.O_DSYNC
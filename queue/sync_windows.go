@@ -0,0 +1,7 @@
+package queue
+
+import "syscall"
+
+// dsyncFlag makes each write to the file synced. Windows has no O_DSYNC,
+// so the file gets opened in write-through mode (FILE_FLAG_WRITE_THROUGH), that syncs its metadata too.
+const dsyncFlag = syscall.O_SYNC
@@ -0,0 +1,130 @@
+package queue
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	errTransactionOpen   = errors.New("a transaction is already open")
+	errNoTransactionOpen = errors.New("no transaction is open")
+)
+
+// BeginTransaction opens a transaction: the records appended until `CommitTransaction` or `AbortTransaction`
+// are part of it, so that a Reader in read committed mode (see `IO_CONSUMER_READ_COMMITTED`) reads either
+// all of them (once committed) or none of them. The transaction's records get the next offsets as usual,
+// while the markers of its beginning, commit and abort get an offset as well.
+// Only one transaction can be open at a time.
+func (w *Writer) BeginTransaction() error {
+	if w.inTxn {
+		return errTransactionOpen
+	}
+	if err := w.appendMarker(recordKindBegin); err != nil {
+		return err
+	}
+	w.inTxn = true
+	w.txnProducers = make(map[uint32]uint64, len(w.producers))
+	for id, seq := range w.producers {
+		w.txnProducers[id] = seq
+	}
+	w.txnUnwritten = len(w.unwritten)
+	return nil
+}
+
+// CommitTransaction commits the open transaction, making its records readable in read committed mode.
+// The pending block gets written and, unless the sync policy is SYNC_NONE, the file synced,
+// so that a committed transaction is not lost on a crash.
+func (w *Writer) CommitTransaction() error {
+	if !w.inTxn {
+		return errNoTransactionOpen
+	}
+	if err := w.appendMarker(recordKindCommit); err != nil {
+		return err
+	}
+	w.inTxn = false
+	w.txnProducers = nil
+	if w.sync.Mode != SYNC_NONE {
+		return w.Sync()
+	}
+	return w.flush()
+}
+
+// AbortTransaction aborts the open transaction: its records are never read in read committed mode.
+// The sequence numbers of the idempotent producers are restored, so that the records can be appended again.
+func (w *Writer) AbortTransaction() error {
+	if !w.inTxn {
+		return errNoTransactionOpen
+	}
+	if err := w.appendMarker(recordKindAbort); err != nil {
+		return err
+	}
+	w.inTxn = false
+	w.producers, w.txnProducers = w.txnProducers, nil
+	// The sequence numbers of its records that are not written yet get dropped as well.
+	w.unwritten = w.unwritten[:w.txnUnwritten]
+	w.pending = make(map[uint32]uint64, len(w.pending))
+	for _, ps := range w.unwritten {
+		w.pending[ps.producerID] = ps.sequence
+	}
+	return w.flush()
+}
+
+// InTransaction tells if a transaction is open.
+func (w *Writer) InTransaction() bool {
+	return w.inTxn
+}
+
+// abortLeftOpen aborts the transaction that a previous run left open (ex: it died in the middle of it),
+// so that the records appended from now on are not taken as part of it.
+// `info` is the one of the file currently written into.
+func (w *Writer) abortLeftOpen(info *segmentInfo) error {
+	open, err := transactionLeftOpen(w.path, w.blocksize, info)
+	if err != nil {
+		return errors.Wrap(err, "looking for a transaction left open")
+	}
+	if !open {
+		return nil
+	}
+	if err := w.appendMarker(recordKindAbort); err != nil {
+		return err
+	}
+	log.Printf("[WARN] Aborted the transaction left open by the previous run, at offset %d.\n", w.next-1)
+	if w.sync.Mode != SYNC_NONE {
+		return w.Sync()
+	}
+	return w.flush()
+}
+
+// transactionLeftOpen tells if the last record of the path is part of a transaction that is not committed nor aborted.
+// `info` is the one of the latest file. If it has no records (ex: it was just created), the previous files get scanned.
+func transactionLeftOpen(path string, blocksize int, info *segmentInfo) (bool, error) {
+	if info.nextOffset > info.baseOffset {
+		return info.openTxn, nil
+	}
+	fnames, err := getSegmentFileNames(path)
+	if err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("looking for files on path '%s'", path))
+	}
+	for i := len(fnames) - 1; i >= 0; i-- {
+		filepath := path + string(os.PathSeparator) + fnames[i]
+		base, err := getBaseOffsetOfFilename(filepath)
+		if err != nil || base >= info.baseOffset {
+			continue
+		}
+		prev, err := scanSegment(filepath, blocksize)
+		if err == io.EOF {
+			continue // Its header is not written yet.
+		}
+		if err != nil {
+			return false, err
+		}
+		if prev.nextOffset > prev.baseOffset {
+			return prev.openTxn, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,108 @@
+package queue
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/devisions/go-playground/go-directio/codec"
+	"github.com/devisions/go-playground/go-directio/config"
+	"github.com/pkg/errors"
+)
+
+// readOffsets reads all the values of the path, using a new Reader, returning their offsets.
+// Each value must be the one written for its offset (see `testValue`).
+func readOffsets(cfg *config.Config) ([]uint64, error) {
+	r, err := NewReader(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = r.Close() }()
+	q, err := NewQueue[string](nil, r, codec.JSON[string]{})
+	if err != nil {
+		return nil, err
+	}
+	var offsets []uint64
+	for {
+		item, err := q.Read()
+		if err == io.EOF || err == os.ErrNotExist {
+			return offsets, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if o, err := testOffset(item.Value); err != nil || o != item.Offset {
+			return nil, errors.New(fmt.Sprintf("got the value '%.20s' from offset %d", item.Value, item.Offset))
+		}
+		offsets = append(offsets, item.Offset)
+	}
+}
+
+// TestReadCommitted appends, between records that are not part of any transaction, a committed transaction, an aborted one
+// and one left open by a Writer that gets dropped (as if it died). It then checks that a Reader in read committed mode reads
+// only the records of the committed transaction and the ones not part of any, while another Reader reads all of them.
+func TestReadCommitted(t *testing.T) {
+	cfg := newTestConfig(t.TempDir())
+	w, err := NewWriter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := NewQueue[string](w, nil, codec.JSON[string]{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := func(until uint64) func() error {
+		return func() error { return appendTestValues(q, w, until, 100) }
+	}
+	// The transaction markers get an offset as well.
+	for _, step := range []func() error{
+		values(2),           // 0-1
+		w.BeginTransaction,  // 2
+		values(5),           // 3-4
+		w.CommitTransaction, // 5
+		w.BeginTransaction,  // 6
+		values(9),           // 7-8
+		w.AbortTransaction,  // 9
+		values(11),          // 10
+		w.BeginTransaction,  // 11
+		values(13),          // 12
+	} {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Dropping the Writer, with the transaction open.
+	w.closeIndexes()
+	_ = w.engine.Close()
+	_ = w.out.Close()
+
+	// The new Writer aborts it (13).
+	if w, err = NewWriter(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = w.Close() }()
+	if q, err = NewQueue[string](w, nil, codec.JSON[string]{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendTestValues(q, w, 15, 100); err != nil { // 14
+		t.Fatal(err)
+	}
+
+	cfg.ConsumerReadCommitted = true
+	offsets, err := readOffsets(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint64{0, 1, 3, 4, 10, 14}; !reflect.DeepEqual(offsets, want) {
+		t.Fatalf("read %v in read committed mode, instead of %v", offsets, want)
+	}
+	cfg.ConsumerReadCommitted = false
+	if offsets, err = readOffsets(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint64{0, 1, 3, 4, 7, 8, 10, 12, 14}; !reflect.DeepEqual(offsets, want) {
+		t.Fatalf("read %v, instead of %v", offsets, want)
+	}
+}
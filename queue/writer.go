@@ -0,0 +1,687 @@
+// Package queue provides a file based queue that is written and read using direct I/O.
+// A `Writer` appends data to files and a `Reader` consumes them, in the same order.
+package queue
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/devisions/go-playground/go-directio/codec"
+	"github.com/devisions/go-playground/go-directio/config"
+	"github.com/devisions/go-playground/go-directio/internal/data"
+	"github.com/devisions/go-playground/go-directio/ioengine"
+	"github.com/ncw/directio"
+	"github.com/pkg/errors"
+)
+
+// Writer appends data to the files of a path, moving to a new file
+// when the next record does not fit into the current one.
+// A Writer is not safe for concurrent use.
+type Writer struct {
+	// The (aligned) buffer that the blocks are filled in, so that the full ones get written together (aka group commit).
+	buf []byte
+
+	// The blocks of `buf`, written as one I/O vector each.
+	blocks [][]byte
+
+	// Full blocks at the start of `buf`, not yet written.
+	full int
+
+	// The block being filled: the one of `buf` after the full ones.
+	block []byte
+
+	// Size of the `block`.
+	blocksize int
+
+	// Bytes of the `block` already filled with records, not yet written.
+	used int
+
+	// Path where the files are written.
+	path string
+
+	// How the files get created and opened, including their maximum size.
+	files *fileOptions
+
+	// The I/O mode of the files: direct I/O or, if the path does not support it, buffered I/O.
+	ioMode string
+
+	// In buffered I/O mode, bytes written into the current file since its pages were last dropped from the page cache.
+	undropped int64
+
+	// The current file to write into.
+	out *os.File
+
+	// Writes the blocks into the current file.
+	engine ioengine.Engine
+
+	// Bytes written into the current file. It is always a multiple of `blocksize`.
+	written int64
+
+	// Whether a batch is being appended, in which case the sync policy is applied after its last record.
+	inBatch bool
+
+	// Offset of the next record to append.
+	next uint64
+
+	// The (offset) index and the time index of the current file.
+	idx *os.File
+	tix *os.File
+
+	// Builds the index entries of the current file. The ones of the records
+	// in the pending block get written once the block is written.
+	index *indexBuilder
+
+	// When the written data gets synced to the storage device.
+	sync SyncPolicy
+
+	// Records and bytes of records appended since the last sync.
+	unsyncedRecords int
+	unsyncedBytes   int64
+
+	// When the last sync happened.
+	lastSync time.Time
+
+	// Latency of the syncs done so far.
+	syncStats SyncStats
+
+	// Writes done so far, by I/O mode.
+	ioStats IOStats
+
+	// The sequence number of the last record written by each idempotent producer, by the producer's id.
+	producers map[uint32]uint64
+
+	// The sequence numbers of the records of the idempotent producers that are not written yet, in the order they got appended.
+	// They are applied to `producers` once the blocks holding the records get written.
+	unwritten []producerSequence
+
+	// The last one of the `unwritten` sequence numbers of each idempotent producer, by the producer's id.
+	pending map[uint32]uint64
+
+	// Whether a transaction is open, in which case the appended records are part of it.
+	inTxn bool
+
+	// The sequence numbers of the idempotent producers as they were when the open transaction began,
+	// restored if it gets aborted, and how many of the `unwritten` ones were appended before it began.
+	txnProducers map[uint32]uint64
+	txnUnwritten int
+
+	// The error of the write or sync that failed. The Writer cannot be used anymore, as the records appended since
+	// the last successful write or sync might be lost. A new Writer recovers from what the files hold.
+	failed error
+}
+
+// NewWriter creates the path (if missing) and opens the file to start writing into.
+// The block size gets validated or, if 0, set, according to the direct I/O alignment of the path (see `ResolveBlockSize`).
+// It fails if the path does not support direct I/O, unless the direct I/O policy allows falling back to buffered I/O.
+func NewWriter(cfg *config.Config) (*Writer, error) {
+	sp, err := newSyncPolicy(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "using the sync policy")
+	}
+	if done, err := data.MakePathIfNotExists(cfg.Path); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("creating (missing) path '%s' for writing files into", cfg.Path))
+	} else if done {
+		log.Println("Created the (missing) path", cfg.Path)
+	}
+	if err := ResolveBlockSize(cfg); err != nil {
+		return nil, err
+	}
+	ioMode, err := selectIOMode(cfg.Path, cfg.BlockSize, cfg.DirectIOPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	files := &fileOptions{
+		blocksize:   cfg.BlockSize,
+		maxsize:     cfg.MaxFileSizeBytes,
+		flags:       sp.openFlags(),
+		preallocate: cfg.Preallocate || cfg.RecycleSegments > 0,
+		recycle:     cfg.RecycleSegments > 0,
+	}
+	f, info, err := getInitialFileForWriting(cfg.Path, files)
+	if err != nil {
+		return nil, errors.Wrap(err, "looking for the next file to write into")
+	}
+	if f == nil { // This should never happen; used just for safety.
+		return nil, errors.New("no file to write could be used")
+	}
+
+	bufsize := cfg.WriteBufferBytes
+	if bufsize == 0 {
+		bufsize = cfg.BlockSize
+	}
+	if bufsize < 0 || bufsize%cfg.BlockSize != 0 {
+		_ = f.Close()
+		return nil, errors.New(fmt.Sprintf("%s %d is not a positive multiple of the block size of %d bytes", config.IO_WRITE_BUFFER_BYTES, bufsize, cfg.BlockSize))
+	}
+	producers, err := loadProducerSequences(cfg.Path, cfg.BlockSize, cfg.ProducerDedupSegments)
+	if err != nil {
+		_ = f.Close()
+		return nil, errors.Wrap(err, "rebuilding the sequence numbers of the idempotent producers")
+	}
+	engine, err := newEngine(cfg)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	w := Writer{
+		buf:       directio.AlignedBlock(bufsize),
+		blocksize: cfg.BlockSize,
+		path:      cfg.Path,
+		files:     files,
+		ioMode:    ioMode,
+		out:       f,
+		engine:    engine,
+		written:   info.size(cfg.BlockSize),
+		next:      info.nextOffset,
+		sync:      sp,
+		lastSync:  time.Now(),
+		producers: producers,
+		pending:   make(map[uint32]uint64),
+	}
+	w.block = w.buf[:w.blocksize]
+	w.blocks = splitBlocks(w.buf, w.blocksize)
+	if err := w.openIndexes(info.index); err != nil {
+		_ = f.Close()
+		_ = engine.Close()
+		return nil, err
+	}
+	info.index.reset() // Its entries are already written.
+	if err := w.syncPath(); err != nil {
+		_ = w.Close()
+		return nil, err
+	}
+	if err := w.abortLeftOpen(info); err != nil {
+		_ = w.Close()
+		return nil, err
+	}
+	return &w, nil
+}
+
+// BufferSize returns the size of the buffer that the blocks get written from (see `AppendBatch`).
+func (w *Writer) BufferSize() int {
+	return len(w.buf)
+}
+
+// Blocksize returns the size of the block used for writing.
+func (w *Writer) Blocksize() int {
+	return w.blocksize
+}
+
+// Name returns the name of the file currently written into.
+func (w *Writer) Name() string {
+	return w.out.Name()
+}
+
+// IOMode returns the I/O mode of the files: `data.IO_MODE_DIRECT` or `data.IO_MODE_BUFFERED`.
+func (w *Writer) IOMode() string {
+	return w.ioMode
+}
+
+// Engine returns the name of the I/O engine that the blocks get written with.
+func (w *Writer) Engine() string {
+	return w.engine.Name()
+}
+
+// NextOffset returns the offset that the next appended record gets.
+func (w *Writer) NextOffset() uint64 {
+	return w.next
+}
+
+// SyncPolicy returns the policy of syncing the written data to the storage device.
+func (w *Writer) SyncPolicy() SyncPolicy {
+	return w.sync
+}
+
+// IOStats returns the writes (of blocks) done so far, by I/O mode: direct I/O or buffered I/O (see `IOMode`).
+func (w *Writer) IOStats() IOStats {
+	return w.ioStats
+}
+
+// SyncStats returns the latency of the syncs done so far.
+func (w *Writer) SyncStats() SyncStats {
+	return w.syncStats
+}
+
+// Append appends the payload, as a record, to the pending block.
+// Each record gets the next offset: the offsets start at 0 and keep increasing across files.
+// Records are packed: many of them share a block and a record can continue in the next block(s).
+// The blocks that get full are written to file once the write buffer is full (see `IO_WRITE_BUFFER_BYTES`),
+// while the rest of them are written on `Flush`.
+// A record is never split across files: if it does not fit into the current one, it goes into a new one.
+// Depending on the sync policy, the pending block gets written and the file synced after the record is appended.
+func (w *Writer) Append(payload []byte) error {
+	return w.appendData(codec.RawID, 0, 0, nil, payload)
+}
+
+// AppendWithMetadata is like `Append`, storing the metadata next to the payload.
+func (w *Writer) AppendWithMetadata(payload []byte, md *Metadata) error {
+	return w.appendData(codec.RawID, 0, 0, md, payload)
+}
+
+// AppendIdempotent is like `AppendWithMetadata` (`md` can be nil), for an idempotent producer: the record stores
+// the producer's id (that must not be 0) and the `sequence` number, that must be greater than the ones of the
+// producer's previous records. Otherwise, the record is a duplicate (ex: an append retried after a timeout),
+// so it is rejected with a `DuplicateError`.
+func (w *Writer) AppendIdempotent(producerID uint32, sequence uint64, payload []byte, md *Metadata) error {
+	if producerID == 0 {
+		return errReservedProducerID
+	}
+	return w.appendData(codec.RawID, producerID, sequence, md, payload)
+}
+
+// AppendBatch appends the payloads, as records, like `Append` does with each one, but as a group (aka group commit):
+// the full blocks get written with a single write (as long as they fit into the write buffer, see `IO_WRITE_BUFFER_BYTES`)
+// and the sync policy is applied once, after the last record (ex: a single sync in SYNC_ALWAYS mode).
+// The last block, if not full, stays pending (as with `Append`), unless the records get synced.
+// If appending a record fails, the ones before it are still appended.
+func (w *Writer) AppendBatch(payloads [][]byte) error {
+	return w.appendBatch(len(payloads), func(i int) (byte, []byte, error) {
+		return codec.RawID, payloads[i], nil
+	})
+}
+
+// appendBatch appends `n` records as a group (see `AppendBatch`), getting the encoded data of each one, along with the id
+// of the codec used for encoding it, from `record`. Then, it writes the full blocks or, if the sync policy says so, syncs the records.
+func (w *Writer) appendBatch(n int, record func(i int) (byte, []byte, error)) error {
+	w.inBatch = true
+	for i := 0; i < n; i++ {
+		codecID, ed, err := record(i)
+		if err == nil {
+			err = w.appendData(codecID, 0, 0, nil, ed)
+		}
+		if err != nil {
+			w.inBatch = false
+			return err
+		}
+	}
+	w.inBatch = false
+	if w.syncDue() {
+		return w.Sync()
+	}
+	return w.writeOut()
+}
+
+// ProducerSequence returns the sequence number of the last record appended by the idempotent producer having `producerID`,
+// so that a restarted producer can continue its numbering. It returns false if no such record is known (see `IO_PRODUCER_DEDUP_SEGMENTS`).
+func (w *Writer) ProducerSequence(producerID uint32) (uint64, bool) {
+	return w.lastSequence(producerID)
+}
+
+// appendData appends the payload, that was encoded using the codec having `codecID`, and its metadata (if any).
+// Unless `producerID` is 0, the record is rejected if the producer already appended the `sequence` number (or a greater one).
+func (w *Writer) appendData(codecID byte, producerID uint32, sequence uint64, md *Metadata, payload []byte) error {
+	if err := w.checkFailed(); err != nil {
+		return err
+	}
+	if last, found := w.lastSequence(producerID); found && producerID != 0 && sequence <= last {
+		return &DuplicateError{ProducerID: producerID, Sequence: sequence, LastSequence: last}
+	}
+	envelope := Metadata{}
+	if md != nil {
+		envelope = *md
+	}
+	if len(envelope.Headers) > MAX_HEADERS {
+		return errors.New(fmt.Sprintf("%d headers exceed the maximum of %d", len(envelope.Headers), MAX_HEADERS))
+	}
+	if envelope.Timestamp.IsZero() {
+		envelope.Timestamp = time.Now()
+	}
+	ed := encodeEnvelope(&envelope, payload)
+	if len(ed) > MAX_EDL {
+		return errors.New(fmt.Sprintf("encoded data length %d exceeds the maximum of %d", len(ed), MAX_EDL))
+	}
+	if !w.fits(len(ed)) {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	h := recordHeader{kind: recordKindData, codec: codecID, offset: w.next, producerID: producerID, sequence: sequence}
+	if w.inTxn {
+		h.flags = recordFlagTransactional
+	}
+	if producerID != 0 {
+		w.unwritten = append(w.unwritten, producerSequence{producerID: producerID, sequence: sequence, end: recordEnd(w.position(), len(ed), w.blocksize)})
+		w.pending[producerID] = sequence
+	}
+	if err := w.append(h, ed); err != nil {
+		return err
+	}
+	w.next++
+	w.unsyncedRecords++
+	w.unsyncedBytes += int64(len(ed))
+	if !w.inBatch && w.syncDue() {
+		return w.Sync()
+	}
+	return nil
+}
+
+// appendMarker appends the transaction marker of `kind`, that gets the next offset.
+func (w *Writer) appendMarker(kind byte) error {
+	if err := w.checkFailed(); err != nil {
+		return err
+	}
+	if !w.fits(0) {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	if err := w.append(recordHeader{kind: kind, offset: w.next}, nil); err != nil {
+		return err
+	}
+	w.next++
+	return nil
+}
+
+// fits tells if a record having `edl` bytes of encoded data, followed by
+// the end of segment record, fits into the current file.
+// A file with no records accepts any record, so that big records can still be written.
+func (w *Writer) fits(edl int) bool {
+	pos := w.position()
+	if pos == int64(w.blocksize) {
+		return true // There is only the header.
+	}
+	end := recordEnd(recordEnd(pos, edl, w.blocksize), 0, w.blocksize)
+	// The file size gets rounded up to a multiple of blocks.
+	if rem := end % int64(w.blocksize); rem > 0 {
+		end += int64(w.blocksize) - rem
+	}
+	return end <= w.files.maxsize
+}
+
+// position returns the position in the current file where the next byte of a record goes.
+func (w *Writer) position() int64 {
+	return w.written + int64(w.full*w.blocksize+w.used)
+}
+
+// append puts the record into the pending block, moving to the next block every time it gets full.
+func (w *Writer) append(h recordHeader, ed []byte) error {
+	// A record's header is never split across blocks.
+	if w.blocksize-w.used < recordHeaderSize {
+		if err := w.padBlock(); err != nil {
+			return err
+		}
+	}
+	if h.kind == recordKindData {
+		w.index.add(h.offset, w.position(), envelopeTimestamp(ed))
+	}
+	putRecordHeader(w.block[w.used:], h, ed) // putting first the header
+	w.used += recordHeaderSize
+	for i := 0; i < len(ed); {
+		n := copy(w.block[w.used:], ed[i:]) // putting the encoded data, as much as it fits
+		i += n
+		w.used += n
+		if w.used == w.blocksize {
+			if err := w.nextBlock(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rotate seals the current file, by writing the end of segment record, and moves to a new file.
+// The new file is named after the offset of the next record.
+func (w *Writer) rotate() error {
+	if err := w.append(recordHeader{kind: recordKindEnd, offset: w.next}, nil); err != nil {
+		return err
+	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if w.sync.Mode != SYNC_NONE {
+		if err := w.syncOut(); err != nil {
+			return err
+		}
+	}
+	if err := w.dropPageCache(); err != nil {
+		return err
+	}
+	if err := w.out.Close(); err != nil {
+		log.Printf("[WARN] Failed to close existing file '%s'. Reason:%s\n", w.out.Name(), err)
+	}
+	w.closeIndexes()
+	f, info, err := openNewFileForWriting(w.path, w.next, w.files)
+	if err != nil {
+		return err
+	}
+	log.Println("Writing to new file", f.Name())
+	w.out = f
+	w.written = int64(w.blocksize)
+	if err := w.openIndexes(info.index); err != nil {
+		return err
+	}
+	return w.syncPath()
+}
+
+// openIndexes opens the indexes of the current file, for appending the entries built by `index`.
+func (w *Writer) openIndexes(index *indexBuilder) error {
+	idx, err := openIndexForWriting(indexFilepath(w.out.Name()))
+	if err != nil {
+		return err
+	}
+	tix, err := openIndexForWriting(timeIndexFilepath(w.out.Name()))
+	if err != nil {
+		_ = idx.Close()
+		return err
+	}
+	w.idx, w.tix, w.index = idx, tix, index
+	return nil
+}
+
+func (w *Writer) closeIndexes() {
+	for _, f := range []*os.File{w.idx, w.tix} {
+		if err := f.Close(); err != nil {
+			log.Printf("[WARN] Failed to close existing index '%s'. Reason:%s\n", f.Name(), err)
+		}
+	}
+}
+
+// Flush writes the pending blocks (if any), padding the unused tail of the last one (see `recordKindPadding`).
+// In SYNC_INTERVAL mode, it also syncs the file if the interval since the last sync passed,
+// so that calling it periodically, while there is nothing to append, bounds the time that data stays unsynced.
+func (w *Writer) Flush() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if w.syncDue() {
+		return w.Sync()
+	}
+	return nil
+}
+
+// Sync writes the pending blocks (if any) and syncs the file to the storage device,
+// regardless of the sync policy. Frequent syncs waste space, as each one pads the pending block.
+func (w *Writer) Sync() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	return w.syncOut()
+}
+
+// syncDue tells if, according to the sync policy, the appended records must be synced now.
+func (w *Writer) syncDue() bool {
+	switch w.sync.Mode {
+	case SYNC_ALWAYS:
+		return w.unsyncedRecords > 0
+	case SYNC_RECORDS:
+		return w.unsyncedRecords >= w.sync.EveryRecords
+	case SYNC_BYTES:
+		return w.unsyncedBytes >= w.sync.EveryBytes
+	case SYNC_INTERVAL:
+		return w.unsyncedRecords > 0 && time.Since(w.lastSync) >= w.sync.Interval
+	}
+	return false
+}
+
+// syncOut syncs the current file, measuring the latency. Its indexes are not synced, as they can be rebuilt.
+func (w *Writer) syncOut() error {
+	if err := w.checkFailed(); err != nil {
+		return err
+	}
+	start := time.Now()
+	if err := w.out.Sync(); err != nil {
+		return w.fail(errors.Wrap(err, fmt.Sprintf("syncing file %s", w.out.Name())))
+	}
+	w.lastSync = time.Now()
+	w.syncStats.add(w.lastSync.Sub(start))
+	w.unsyncedRecords, w.unsyncedBytes = 0, 0
+	return nil
+}
+
+// syncPath syncs the path, so that the current file is not lost (as an entry of its directory) on a crash.
+func (w *Writer) syncPath() error {
+	if w.sync.Mode == SYNC_NONE {
+		return nil
+	}
+	return syncDir(w.path)
+}
+
+// flush writes the pending blocks (if any), padding the unused tail of the last one (see `recordKindPadding`).
+func (w *Writer) flush() error {
+	if w.used > 0 {
+		if err := w.padBlock(); err != nil {
+			return err
+		}
+	}
+	return w.writeOut()
+}
+
+// padBlock pads the unused tail of the pending block and moves to the next block.
+func (w *Writer) padBlock() error {
+	for i := w.used; i < w.blocksize; i++ {
+		w.block[i] = 0
+	}
+	if w.blocksize-w.used >= recordHeaderSize {
+		putRecordHeader(w.block[w.used:], recordHeader{kind: recordKindPadding, offset: w.next}, nil)
+	}
+	return w.nextBlock()
+}
+
+// nextBlock moves to the next block of the buffer, once the pending one is full.
+// If the buffer is full, its blocks get written.
+func (w *Writer) nextBlock() error {
+	w.full++
+	w.used = 0
+	if w.full*w.blocksize == len(w.buf) {
+		return w.writeOut()
+	}
+	w.block = w.buf[w.full*w.blocksize : (w.full+1)*w.blocksize]
+	return nil
+}
+
+// writeOut writes the full blocks of the buffer (if any), using the I/O engine (a single write of an I/O vector per block),
+// and then the index entries of the records they contain. The pending block (if any) moves to the start of the buffer.
+// The sequence numbers of the records of the idempotent producers that got written are applied.
+// In SYNC_DSYNC mode, each write is a sync, so its latency gets measured.
+func (w *Writer) writeOut() error {
+	if err := w.checkFailed(); err != nil {
+		return err
+	}
+	if w.full == 0 {
+		return nil
+	}
+	n := w.full * w.blocksize
+	start := time.Now()
+	if err := w.engine.WriteAt(w.out, w.blocks[:w.full], w.written); err != nil {
+		return w.fail(errors.Wrap(err, "writing to file"))
+	}
+	if w.sync.Mode == SYNC_DSYNC {
+		w.lastSync = time.Now()
+		w.syncStats.add(w.lastSync.Sub(start))
+	}
+	w.ioStats.add(w.out.Name(), n)
+	w.written += int64(n)
+	w.full = 0
+	w.sequencesWritten()
+	copy(w.buf, w.block[:w.used])
+	w.block = w.buf[:w.blocksize]
+	if w.ioMode == data.IO_MODE_BUFFERED {
+		w.undropped += int64(n)
+		if w.undropped >= dropPageCacheBytes {
+			if err := w.dropPageCache(); err != nil {
+				return err
+			}
+		}
+	}
+	// The entries of the records in the pending block get written once it is written.
+	entries := 0
+	for entries < len(w.index.entries) && w.index.entries[entries].block < w.written {
+		entries++
+	}
+	if entries > 0 {
+		if _, err := w.idx.Write(encodeIndex(w.index.entries[:entries])); err != nil {
+			return errors.Wrap(err, "writing to index")
+		}
+		if _, err := w.tix.Write(encodeTimeIndex(w.index.timeEntries[:entries])); err != nil {
+			return errors.Wrap(err, "writing to time index")
+		}
+		w.index.drop(entries)
+	}
+	return nil
+}
+
+// fail makes the Writer fail from now on, because of `err` (see `Writer.failed`), that it returns.
+// The sequence numbers of the records not written get dropped.
+func (w *Writer) fail(err error) error {
+	w.failed = err
+	w.unwritten, w.pending = nil, make(map[uint32]uint64)
+	return err
+}
+
+// checkFailed returns an error if the Writer failed before.
+func (w *Writer) checkFailed() error {
+	if w.failed != nil {
+		return errors.Wrap(w.failed, "the Writer failed before (a new one recovers from the files)")
+	}
+	return nil
+}
+
+// dropPageCache syncs (using fdatasync) the data written into the current file using buffered I/O, since
+// its pages were last dropped, and drops them from the page cache. Nothing is done in direct I/O mode.
+func (w *Writer) dropPageCache() error {
+	if w.ioMode != data.IO_MODE_BUFFERED || w.undropped == 0 {
+		return nil
+	}
+	if err := data.SyncData(w.out); err != nil {
+		return w.fail(errors.Wrap(err, fmt.Sprintf("syncing the data of file %s", w.out.Name())))
+	}
+	if err := data.DropPageCache(w.out); err != nil {
+		log.Printf("[WARN] Failed to drop the pages of file '%s' from the page cache. Reason:%s\n", w.out.Name(), err)
+	}
+	w.undropped = 0
+	return nil
+}
+
+// Close writes the pending blocks and closes the file currently written into, along with its indexes, and the I/O engine.
+// Unless the sync policy is SYNC_NONE, the file gets synced before (as it does in buffered I/O mode). An open transaction gets aborted.
+func (w *Writer) Close() error {
+	if w.out == nil { // Just for safety reasons.
+		return nil
+	}
+	var err error
+	if w.inTxn {
+		err = w.appendMarker(recordKindAbort)
+		w.inTxn = false
+	}
+	if err == nil {
+		err = w.flush()
+	}
+	if err == nil && w.sync.Mode != SYNC_NONE {
+		err = w.syncOut()
+	}
+	if err == nil {
+		err = w.dropPageCache()
+	}
+	w.closeIndexes()
+	if cerr := w.engine.Close(); err == nil && cerr != nil {
+		err = errors.Wrap(cerr, "closing the I/O engine")
+	}
+	if err != nil {
+		_ = w.out.Close()
+		return err
+	}
+	return w.out.Close()
+}